@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// AnomalyConfig enables anomaly detection on a module's numeric readings.
+// Each action's readings are tracked separately with an exponentially
+// weighted moving mean and variance, and a reading is flagged when its
+// z-score against that trend exceeds ZThreshold.
+type AnomalyConfig struct {
+	Alpha      float64 `json:"alpha"`
+	ZThreshold float64 `json:"z_threshold"`
+}
+
+func (c AnomalyConfig) Validate() error {
+	if c.Alpha <= 0 || c.Alpha > 1 {
+		return errors.New("anomaly alpha must be in (0, 1]")
+	}
+	if c.ZThreshold <= 0 {
+		return errors.New("anomaly z_threshold must be positive")
+	}
+	return nil
+}
+
+// AnomalyReading replaces a bare numeric result when anomaly detection is
+// enabled for the module.
+type AnomalyReading struct {
+	Value     float64 `json:"value"`
+	Anomalous bool    `json:"anomalous"`
+	ZScore    float64 `json:"z_score"`
+}
+
+type anomalyDetector struct {
+	config AnomalyConfig
+
+	mu     sync.Mutex
+	trends map[string]*ewma
+}
+
+type ewma struct {
+	mean     float64
+	variance float64
+}
+
+func newAnomalyDetector(config AnomalyConfig) *anomalyDetector {
+	return &anomalyDetector{
+		config: config,
+		trends: map[string]*ewma{},
+	}
+}
+
+// Observe scores val against the action's trend so far, then folds it into
+// the trend.
+func (d *anomalyDetector) Observe(action string, val float64) AnomalyReading {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	trend, ok := d.trends[action]
+	if !ok {
+		d.trends[action] = &ewma{mean: val}
+		return AnomalyReading{Value: val}
+	}
+
+	diff := val - trend.mean
+	var z float64
+	if trend.variance > 0 {
+		z = diff / math.Sqrt(trend.variance)
+	}
+
+	incr := d.config.Alpha * diff
+	trend.mean += incr
+	trend.variance = (1 - d.config.Alpha) * (trend.variance + diff*incr)
+
+	return AnomalyReading{
+		Value:     val,
+		Anomalous: math.Abs(z) > d.config.ZThreshold,
+		ZScore:    z,
+	}
+}
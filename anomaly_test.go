@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAnomalyConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		config  AnomalyConfig
+		wantErr bool
+	}{
+		{AnomalyConfig{Alpha: 0.1, ZThreshold: 3}, false},
+		{AnomalyConfig{Alpha: 1, ZThreshold: 3}, false},
+		{AnomalyConfig{Alpha: 0, ZThreshold: 3}, true},
+		{AnomalyConfig{Alpha: 1.1, ZThreshold: 3}, true},
+		{AnomalyConfig{Alpha: 0.1, ZThreshold: 0}, true},
+	} {
+		if err := tc.config.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v, want error: %v", tc.config, err, tc.wantErr)
+		}
+	}
+}
+
+func TestAnomalyDetectorFlagsSpike(t *testing.T) {
+	d := newAnomalyDetector(AnomalyConfig{Alpha: 0.2, ZThreshold: 3})
+
+	// the trend's variance needs a few readings to settle before noise stops
+	// looking anomalous
+	for i := 0; i < 50; i++ {
+		val := 20 + 0.1*float64(i%3)
+		if reading := d.Observe("tc", val); i >= 10 && reading.Anomalous {
+			t.Fatalf("reading %d (%v) flagged with z-score %v", i, val, reading.ZScore)
+		}
+	}
+
+	spike := d.Observe("tc", 40)
+	if !spike.Anomalous || spike.Value != 40 || spike.ZScore <= 3 {
+		t.Errorf("spike wasn't flagged: %+v", spike)
+	}
+
+	// each action has its own trend
+	if other := d.Observe("rh", 40); other.Anomalous {
+		t.Errorf("first reading of another action was flagged: %+v", other)
+	}
+}
+
+func TestActReportsAnomalies(t *testing.T) {
+	mgr := newTestManager()
+	spec := fakeSpec(`{"value": 1}`)
+	spec.Anomaly = &AnomalyConfig{Alpha: 0.5, ZThreshold: 3}
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": spec})
+
+	result, err := mgr.Act("a", "read", mgr.Binder(nil))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if _, ok := result.(AnomalyReading); !ok {
+		encoded, _ := json.Marshal(result)
+		t.Errorf("got %s, want an AnomalyReading", encoded)
+	}
+}
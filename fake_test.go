@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpioreg"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+)
+
+func init() {
+	ModuleIndex["fake"] = func() Module { return &fakeModule{} }
+	ModuleIndex["fake_i2c"] = func() Module { return &fakeI2CModule{} }
+	ModuleIndex["fake_default"] = func() Module { return &fakeDefaultModule{} }
+}
+
+// fakeModule stands in for real hardware in tests.
+type fakeModule struct {
+	config fakeModuleConfig
+
+	mu      sync.Mutex
+	stopped bool
+	acts    int
+}
+type fakeModuleConfig struct {
+	Value     float64 `json:"value"`
+	InitError string  `json:"init_error"`
+	StopError string  `json:"stop_error"`
+	WarmupMS  int     `json:"warmup_ms"`
+}
+
+type fakeSleepRequest struct {
+	MS int `json:"ms"`
+}
+
+type fakeFailRequest struct {
+	Kind string `json:"kind"`
+}
+
+func (*fakeModule) Actions() []string { return []string{"read", "sleep", "fail"} }
+
+func (m *fakeModule) Warmup() time.Duration {
+	return time.Duration(m.config.WarmupMS) * time.Millisecond
+}
+
+// fakeInitializations counts every fakeModule Initialize, so that tests can
+// tell whether any hardware would have been touched.
+var fakeInitializations atomic.Int64
+
+func (m *fakeModule) Initialize(sp ServiceProvider, binder Binder) error {
+	fakeInitializations.Add(1)
+	if err := binder.BindData(&m.config); err != nil {
+		return err
+	}
+	if m.config.InitError != "" {
+		return errors.New(m.config.InitError)
+	}
+	return nil
+}
+
+func (m *fakeModule) Act(action string, body Binder) (interface{}, error) {
+	m.mu.Lock()
+	m.acts++
+	m.mu.Unlock()
+
+	switch action {
+	case "read":
+		return m.config.Value, nil
+	case "sleep":
+		var request = &fakeSleepRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Duration(request.MS) * time.Millisecond)
+		return m.config.Value, nil
+	case "fail":
+		var request = &fakeFailRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+		switch request.Kind {
+		case "input":
+			return nil, InputError{error: errors.New("bad input")}
+		case "not_found":
+			return nil, NotFoundError{error: errors.New("no such thing")}
+		case "rate_limit":
+			return nil, RateLimitError{Remaining: time.Second}
+		default:
+			return nil, errors.New("broken")
+		}
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+func (m *fakeModule) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	if m.config.StopError != "" {
+		return errors.New(m.config.StopError)
+	}
+	return nil
+}
+
+func (m *fakeModule) isStopped() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stopped
+}
+
+// fakeI2CModule is a fakeModule that requires the I2C subsystem.
+type fakeI2CModule struct {
+	fakeModule
+}
+
+func (*fakeI2CModule) Requires() []string { return []string{SubsystemI2C} }
+
+// fakeDefaultModule is a fakeModule whose default action is "read".
+type fakeDefaultModule struct {
+	fakeModule
+}
+
+func (*fakeDefaultModule) DefaultAction() string { return "read" }
+
+// newTestManager returns a ManagerAgent without any hardware, whose modules
+// aren't persisted anywhere.
+func newTestManager() *ManagerAgent {
+	return NewManagerAgent(&ServiceAgent{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestServer serves mgr like main does, without a state file.
+func newTestServer(t *testing.T, mgr *ManagerAgent) *httptest.Server {
+	t.Helper()
+	sp := mgr.ServiceProvider.(*ServiceAgent)
+	runner := NewActionRunner(mgr, NewActionMetrics(), DefaultActTimeout)
+	scheduler := NewScheduler(runner)
+	srv := httptest.NewServer(requestIDs(buildMux(runner, sp, scheduler, nil)))
+	t.Cleanup(func() {
+		srv.Close()
+		scheduler.StopAll(context.Background())
+	})
+	return srv
+}
+
+// scrape returns everything metrics serves.
+func scrape(t *testing.T, metrics *ActionMetrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/metrics got status %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+// fakeSpec is a spec for a fakeModule with the given config.
+func fakeSpec(config string) ModuleSpec {
+	if config == "" {
+		config = "{}"
+	}
+	return ModuleSpec{Source: "fake", Config: json.RawMessage(config)}
+}
+
+// mustInitialize initializes specs on mgr, failing the test if it can't.
+func mustInitialize(t *testing.T, mgr *ManagerAgent, specs map[string]ModuleSpec) {
+	t.Helper()
+	if err := mgr.InitializeModules(specs, false); err != nil {
+		t.Fatalf("failed initializing modules: %v", err)
+	}
+}
+
+// post sends body to srv's path, returning the response and its body.
+func post(t *testing.T, srv *httptest.Server, path string, body string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Post(srv.URL+path, "application/json", bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading POST %s response: %v", path, err)
+	}
+	return resp, respBody
+}
+
+// bind binds body into ptr the way an action or config is bound.
+func bind(body string, ptr interface{}) error {
+	return (&JSONBinder{requestBody: bytes.NewBufferString(body)}).BindData(ptr)
+}
+
+var (
+	testPinsMu sync.Mutex
+	testPins   = map[string]*gpiotest.Pin{}
+)
+
+// testPin returns a fake GPIO pin registered with gpioreg under name. Tests
+// should use names of their own, since pins outlive them.
+func testPin(t *testing.T, name string) *gpiotest.Pin {
+	t.Helper()
+	testPinsMu.Lock()
+	defer testPinsMu.Unlock()
+
+	if p, ok := testPins[name]; ok {
+		return p
+	}
+	p := &gpiotest.Pin{N: name, Num: 1000 + len(testPins), EdgesChan: make(chan gpio.Level, 16)}
+	if err := gpioreg.Register(p); err != nil {
+		t.Fatalf("failed registering pin `%s`: %v", name, err)
+	}
+	testPins[name] = p
+	return p
+}
+
+// level reads a fake pin's level.
+func level(p *gpiotest.Pin) gpio.Level {
+	p.Lock()
+	defer p.Unlock()
+	return p.L
+}
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+func TestJSONResponsesHaveContentType(t *testing.T) {
+	srv := newTestServer(t, newTestManager())
+
+	for _, tc := range []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/initialize", `{"modules": {"a": {"source": "fake", "config": {"value": 1}}}}`, http.StatusOK},
+		{"/act", `{"module": "a", "action": "read"}`, http.StatusOK},
+		{"/act", `{"module": "nope", "action": "read"}`, http.StatusNotFound},
+		{"/stop", `{"modules": ["nope"]}`, http.StatusNotFound},
+		{"/stop", `{"modules": ["a"]}`, http.StatusOK},
+	} {
+		resp, body := post(t, srv, tc.path, tc.body)
+		if resp.StatusCode != tc.status {
+			t.Errorf("POST %s %s: got status %d, want %d", tc.path, tc.body, resp.StatusCode, tc.status)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("POST %s %s: got Content-Type %q", tc.path, tc.body, ct)
+		}
+		if !json.Valid(body) {
+			t.Errorf("POST %s %s: body isn't JSON: %s", tc.path, tc.body, body)
+		}
+	}
+}
+
+func TestStopReportsCountWithErrorStatus(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"stop_error": "wedged"}`)})
+	srv := newTestServer(t, mgr)
+
+	resp, body := post(t, srv, "/stop", `{"modules": ["a"]}`)
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d, want 500", resp.StatusCode)
+	}
+
+	var stopped StopResponse
+	if err := json.Unmarshal(body, &stopped); err != nil {
+		t.Fatalf("failed decoding response %s: %v", body, err)
+	}
+	if stopped.NumStopped != 1 {
+		t.Errorf("got num_stopped %d, want 1", stopped.NumStopped)
+	}
+}
+
+func TestActAndBatchAgreeOnErrorStatus(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	for _, tc := range []struct {
+		act    string
+		status int
+	}{
+		{`{"module": "a", "action": "read"}`, http.StatusOK},
+		{`{"module": "a", "action": "fail", "config": {"kind": "input"}}`, http.StatusBadRequest},
+		{`{"module": "a", "action": "fail", "config": {"kind": "not_found"}}`, http.StatusNotFound},
+		{`{"module": "a", "action": "fail", "config": {"kind": "rate_limit"}}`, http.StatusTooManyRequests},
+		{`{"module": "a", "action": "fail"}`, http.StatusInternalServerError},
+		{`{"module": "a", "action": "nope"}`, http.StatusNotFound},
+		{`{"module": "nope", "action": "read"}`, http.StatusNotFound},
+	} {
+		resp, body := post(t, srv, "/act", tc.act)
+		if resp.StatusCode != tc.status {
+			t.Errorf("/act %s: got status %d, want %d: %s", tc.act, resp.StatusCode, tc.status, body)
+		}
+
+		resp, body = post(t, srv, "/act/batch", `{"actions": [`+tc.act+`]}`)
+		var batch BatchActResponse
+		if err := json.Unmarshal(body, &batch); err != nil || resp.StatusCode != http.StatusOK || len(batch.Results) != 1 {
+			t.Fatalf("/act/batch %s: got status %d and %s", tc.act, resp.StatusCode, body)
+		}
+		code := http.StatusOK
+		if batch.Results[0].Error != nil {
+			code = batch.Results[0].Error.Code
+		}
+		if code != tc.status {
+			t.Errorf("/act/batch %s: got code %d, want %d", tc.act, code, tc.status)
+		}
+	}
+}
+
+func TestMetricsCollapseUnknownLabels(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	post(t, srv, "/act", `{"module": "a", "action": "read"}`)
+	post(t, srv, "/act", `{"module": "a", "action": "made_up_action"}`)
+	post(t, srv, "/act", `{"module": "made_up_module", "action": "read"}`)
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading /metrics: %v", err)
+	}
+
+	for _, series := range []string{
+		`{action="read",module="a"} 1`,
+		`{action="unknown",module="a"} 1`,
+		`{action="unknown",module="unknown"} 1`,
+	} {
+		if !strings.Contains(string(body), series) {
+			t.Errorf("/metrics is missing series %s", series)
+		}
+	}
+	if strings.Contains(string(body), "made_up") {
+		t.Errorf("/metrics has a series for a name from the request:\n%s", body)
+	}
+}
+
+// TestConcurrentActAndInitialize is only meaningful under go test -race.
+func TestConcurrentActAndInitialize(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				post(t, srv, "/act", `{"module": "a", "action": "read"}`)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				body := fmt.Sprintf(`{"modules": {"a": {"source": "fake", "config": {"value": %d}}}}`, i*j)
+				if resp, body := post(t, srv, "/initialize", body); resp.StatusCode != http.StatusOK {
+					t.Errorf("/initialize got status %d: %s", resp.StatusCode, body)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// headerCounter counts how many times a handler writes a status.
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *headerCounter) WriteHeader(status int) {
+	w.writes++
+	w.ResponseRecorder.WriteHeader(status)
+}
+
+func TestActInputErrorWritesOne400(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	sp := mgr.ServiceProvider.(*ServiceAgent)
+	runner := NewActionRunner(mgr, NewActionMetrics(), DefaultActTimeout)
+	handler := buildMux(runner, sp, NewScheduler(runner), nil)
+
+	for _, body := range []string{
+		`{"module": "a", "action": "sleep", "config": {"ms": "soon"}}`,
+		`{"module": "a", "action": "sleep", "config": "soon"}`,
+	} {
+		w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/act", strings.NewReader(body)))
+
+		if w.Code != http.StatusBadRequest || w.writes != 1 {
+			t.Errorf("%s: got status %d written %d times, want one 400", body, w.Code, w.writes)
+		}
+		dec := json.NewDecoder(w.Body)
+		var resp map[string]interface{}
+		if err := dec.Decode(&resp); err != nil {
+			t.Errorf("%s: body isn't JSON: %v", body, err)
+		}
+		if dec.More() {
+			t.Errorf("%s: body has more than one JSON value", body)
+		}
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pihub.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("failed creating stale socket file: %v", err)
+	}
+
+	listener, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	mgr := newTestManager()
+	runner := NewActionRunner(mgr, NewActionMetrics(), DefaultActTimeout)
+	srv := &http.Server{Handler: buildMux(runner, mgr.ServiceProvider.(*ServiceAgent), NewScheduler(runner), nil)}
+	go srv.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://pihub/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz over the socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got status %d, want 200", resp.StatusCode)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("socket has mode %v (%v), want 0660", info.Mode().Perm(), err)
+	}
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file survived shutdown: %v", err)
+	}
+}
+
+func TestTimestampEncodings(t *testing.T) {
+	defer func(format TimestampEncoding) { TimestampFormat = format }(TimestampFormat)
+	ts := Timestamp(time.Date(2020, 1, 2, 3, 4, 5, 6000000, time.UTC))
+
+	for _, tc := range []struct {
+		format string
+		want   string
+	}{
+		{"rfc3339", `"2020-01-02T03:04:05.006Z"`},
+		{"epoch_millis", `1577934245006`},
+	} {
+		encoding, err := ParseTimestampEncoding(tc.format)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		TimestampFormat = encoding
+
+		encoded, err := json.Marshal(ts)
+		if err != nil {
+			t.Fatalf("%s: failed encoding: %v", tc.format, err)
+		}
+		if string(encoded) != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.format, encoded, tc.want)
+		}
+	}
+
+	if _, err := ParseTimestampEncoding("unix"); err == nil {
+		t.Error("an unsupported format parsed")
+	}
+}
+
+func TestBindNullConfigKeepsDefaults(t *testing.T) {
+	want := PCA9685ServoRequest{MinPulseUS: 1000, MaxPulseUS: 2000, MaxAngle: 180}
+
+	for _, body := range []string{``, ` `, `null`, ` null `, `{}`} {
+		var request PCA9685ServoRequest
+		if err := bind(body, &request); err != nil {
+			t.Errorf("%q: bind failed: %v", body, err)
+		}
+		if request != want {
+			t.Errorf("%q: got %+v, want %+v", body, request, want)
+		}
+	}
+
+	var act ActRequest
+	if err := json.Unmarshal([]byte(`{"module": "a", "action": "set_servo_angle", "config": null}`), &act); err != nil {
+		t.Fatalf("failed decoding request: %v", err)
+	}
+	var request PCA9685ServoRequest
+	if err := newTestManager().Binder(act.Config).BindData(&request); err != nil || request != want {
+		t.Errorf("binding a null request config got %+v, %v, want %+v", request, err, want)
+	}
+}
+
+func TestDumpRequestsRedacts(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var received string
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	})
+	handler := dumpRequests(echo, map[string]bool{"/initialize": true}, nil, logger)
+
+	for _, tc := range []struct {
+		path         string
+		wantBody     bool
+		wantRedacted bool
+	}{
+		{"/initialize", false, true},
+		{"/act", true, false},
+	} {
+		logs.Reset()
+		body := `{"secret": "hunter2"}`
+		req := httptest.NewRequest(http.MethodPost, tc.path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer letmein")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if received != body {
+			t.Errorf("%s: handler got body %q, want %q", tc.path, received, body)
+		}
+
+		var line struct {
+			Dump         string `json:"dump"`
+			BodyRedacted bool   `json:"body_redacted"`
+		}
+		if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+			t.Fatalf("%s: failed decoding dump %s: %v", tc.path, logs.Bytes(), err)
+		}
+		if strings.Contains(line.Dump, "letmein") || !strings.Contains(line.Dump, "Authorization: [REDACTED]") {
+			t.Errorf("%s: Authorization wasn't redacted: %s", tc.path, line.Dump)
+		}
+		if strings.Contains(line.Dump, "hunter2") != tc.wantBody {
+			t.Errorf("%s: body dumped: %v, want %v", tc.path, !tc.wantBody, tc.wantBody)
+		}
+		if line.BodyRedacted != tc.wantRedacted {
+			t.Errorf("%s: got body_redacted %v, want %v", tc.path, line.BodyRedacted, tc.wantRedacted)
+		}
+	}
+}
+
+func TestDumpRequestsRedactsSensitiveFields(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var received string
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+	})
+	handler := dumpRequests(echo, nil, map[string]bool{"password": true}, logger)
+
+	body := `{"module": "a", "config": {"users": [{"name": "admin", "password": "hunter2"}]}}`
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/act", strings.NewReader(body)))
+	if received != body {
+		t.Errorf("handler got body %q, want %q", received, body)
+	}
+
+	var line struct {
+		Dump string `json:"dump"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("failed decoding dump %s: %v", logs.Bytes(), err)
+	}
+	if strings.Contains(line.Dump, "hunter2") || !strings.Contains(line.Dump, `"password":"[REDACTED]"`) {
+		t.Errorf("sensitive field wasn't redacted: %s", line.Dump)
+	}
+	if !strings.Contains(line.Dump, `"name":"admin"`) {
+		t.Errorf("other fields were redacted too: %s", line.Dump)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		spec string
+	}{
+		{"module warmup", `{"source": "fake", "config": {"warmup_ms": 100}}`},
+		{"spec warmup", `{"source": "fake", "warmup_seconds": 0.1}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := newTestServer(t, newTestManager())
+			if resp, body := post(t, srv, "/initialize", `{"modules": {"a": `+tc.spec+`}}`); resp.StatusCode != http.StatusOK {
+				t.Fatalf("/initialize got status %d: %s", resp.StatusCode, body)
+			}
+
+			checkWarmup := func(wantStatus int, wantWarmingUp bool) {
+				t.Helper()
+				if resp, body := post(t, srv, "/act", `{"module": "a", "action": "read"}`); resp.StatusCode != wantStatus {
+					t.Errorf("/act got status %d, want %d: %s", resp.StatusCode, wantStatus, body)
+				}
+
+				resp, err := http.Get(srv.URL + "/modules/health")
+				if err != nil {
+					t.Fatalf("GET /modules/health failed: %v", err)
+				}
+				defer resp.Body.Close()
+				var health []struct {
+					WarmingUp bool    `json:"warming_up"`
+					ReadyAt   *string `json:"ready_at"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+					t.Fatalf("failed decoding health: %v", err)
+				}
+				if len(health) != 1 || health[0].WarmingUp != wantWarmingUp || health[0].ReadyAt == nil {
+					t.Errorf("got health %+v, want warming_up %v", health, wantWarmingUp)
+				}
+			}
+
+			checkWarmup(http.StatusServiceUnavailable, true)
+			time.Sleep(150 * time.Millisecond)
+			checkWarmup(http.StatusOK, false)
+		})
+	}
+}
+
+func TestEchoErrorInjection(t *testing.T) {
+	srv := newTestServer(t, newTestManager())
+	if resp, body := post(t, srv, "/initialize", `{"modules": {"echo": {"source": "echo", "config": {"errors": {"bad": "input", "broken": "internal"}, "payload_bytes": 4}}}}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("/initialize got status %d: %s", resp.StatusCode, body)
+	}
+
+	for _, tc := range []struct {
+		action string
+		status int
+	}{
+		{"fine", http.StatusOK},
+		{"bad", http.StatusBadRequest},
+		{"broken", http.StatusInternalServerError},
+	} {
+		act := `{"module": "echo", "action": "` + tc.action + `", "config": {"n": 1}}`
+		resp, body := post(t, srv, "/act", act)
+		if resp.StatusCode != tc.status {
+			t.Errorf("/act %s: got status %d, want %d: %s", tc.action, resp.StatusCode, tc.status, body)
+		}
+
+		resp, body = post(t, srv, "/act/batch", `{"actions": [`+act+`]}`)
+		var batch BatchActResponse
+		if err := json.Unmarshal(body, &batch); err != nil || len(batch.Results) != 1 {
+			t.Fatalf("/act/batch %s: got status %d and %s", tc.action, resp.StatusCode, body)
+		}
+		code := http.StatusOK
+		if batch.Results[0].Error != nil {
+			code = batch.Results[0].Error.Code
+		}
+		if code != tc.status {
+			t.Errorf("/act/batch %s: got code %d, want %d", tc.action, code, tc.status)
+		}
+	}
+
+	_, body := post(t, srv, "/act", `{"module": "echo", "action": "fine", "config": {"n": 1}}`)
+	var echoed ActResponse
+	if err := json.Unmarshal(body, &echoed); err != nil {
+		t.Fatalf("failed decoding %s: %v", body, err)
+	}
+	want := map[string]interface{}{"action": "fine", "config": map[string]interface{}{"n": 1.0}, "payload": "xxxx"}
+	if !reflect.DeepEqual(echoed.Result, want) {
+		t.Errorf("got result %#v, want %#v", echoed.Result, want)
+	}
+}
+
+func TestEchoModuleConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"errors": {"a": "input", "b": "internal"}, "payload_bytes": 16777216}`, false},
+		{`{"errors": {"a": "timeout"}}`, true},
+		{`{"payload_bytes": -1}`, true},
+		{`{"payload_bytes": 16777217}`, true},
+	} {
+		if err := bind(tc.body, &EchoModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 1}`), "b": fakeSpec(`{"value": 2}`)})
+	srv := newTestServer(t, mgr)
+
+	resp, err := http.Get(srv.URL + "/snapshot")
+	if err != nil {
+		t.Fatalf("GET /snapshot failed: %v", err)
+	}
+	snapshot, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /snapshot got status %d: %v", resp.StatusCode, err)
+	}
+
+	post(t, srv, "/stop", `{}`)
+	if resp, body := post(t, srv, "/snapshot/restore", string(snapshot)); resp.StatusCode != http.StatusOK {
+		t.Fatalf("restore got status %d: %s", resp.StatusCode, body)
+	}
+	for name, want := range map[string]float64{"a": 1, "b": 2} {
+		if result, err := mgr.Act(name, "read", mgr.Binder(nil)); err != nil || result != want {
+			t.Errorf("module `%s` read %v, %v after restore, want %v", name, result, err, want)
+		}
+	}
+}
+
+func TestSnapshotRestoreRollsBack(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		snapshot string
+		status   int
+	}{
+		{"invalid", `{"modules": {"c": {"source": "no_such_source"}}}`, http.StatusBadRequest},
+		{"fails to initialize", `{"modules": {"c": {"source": "fake", "config": {"init_error": "no device"}}}}`, http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := newTestManager()
+			mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 1}`)})
+			srv := newTestServer(t, mgr)
+
+			if resp, body := post(t, srv, "/snapshot/restore", tc.snapshot); resp.StatusCode != tc.status {
+				t.Errorf("got status %d, want %d: %s", resp.StatusCode, tc.status, body)
+			}
+			if result, err := mgr.Act("a", "read", mgr.Binder(nil)); err != nil || result != 1.0 {
+				t.Errorf("previous module read %v, %v after a failed restore", result, err)
+			}
+			if _, ok := mgr.Modules["c"]; ok {
+				t.Error("module from the failed snapshot is live")
+			}
+		})
+	}
+}
+
+func TestStop(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		body        string
+		status      int
+		wantStopped []string
+	}{
+		{"named", `{"modules": ["a"]}`, http.StatusOK, []string{"a"}},
+		{"all", `{}`, http.StatusInternalServerError, []string{"a", "b", "wedged"}},
+		{"unknown", `{"modules": ["a", "nope"]}`, http.StatusNotFound, nil},
+		{"failing stop", `{"modules": ["wedged", "b"]}`, http.StatusInternalServerError, []string{"b", "wedged"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := newTestManager()
+			mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(""), "b": fakeSpec(""), "wedged": fakeSpec(`{"stop_error": "wedged"}`)})
+			mods := map[string]*fakeModule{}
+			for name, mod := range mgr.Modules {
+				mods[name] = mod.(*fakeModule)
+			}
+			srv := newTestServer(t, mgr)
+
+			if resp, body := post(t, srv, "/stop", tc.body); resp.StatusCode != tc.status {
+				t.Errorf("got status %d, want %d: %s", resp.StatusCode, tc.status, body)
+			}
+
+			wantStopped := map[string]bool{}
+			for _, name := range tc.wantStopped {
+				wantStopped[name] = true
+			}
+			for name, mod := range mods {
+				_, live := mgr.Modules[name]
+				if mod.isStopped() != wantStopped[name] || live == wantStopped[name] {
+					t.Errorf("module `%s`: stopped %v and live %v, want stopped %v", name, mod.isStopped(), live, wantStopped[name])
+				}
+			}
+		})
+	}
+}
+
+func TestActDefaultAction(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"none":     fakeSpec(`{"value": 1}`),
+		"spec":     {Source: "fake", Config: json.RawMessage(`{"value": 2}`), DefaultAction: "read"},
+		"module":   {Source: "fake_default", Config: json.RawMessage(`{"value": 3}`)},
+		"override": {Source: "fake_default", Config: json.RawMessage(`{"value": 4}`), DefaultAction: "fail"},
+	})
+	srv := newTestServer(t, mgr)
+
+	for _, tc := range []struct {
+		module string
+		status int
+		result interface{}
+	}{
+		{"none", http.StatusBadRequest, nil},
+		{"spec", http.StatusOK, 2.0},
+		{"module", http.StatusOK, 3.0},
+		{"override", http.StatusInternalServerError, nil},
+	} {
+		resp, body := post(t, srv, "/act", `{"module": "`+tc.module+`"}`)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: got status %d, want %d: %s", tc.module, resp.StatusCode, tc.status, body)
+			continue
+		}
+		var act ActResponse
+		if tc.status == http.StatusOK && (json.Unmarshal(body, &act) != nil || act.Result != tc.result) {
+			t.Errorf("%s: got %s, want result %v", tc.module, body, tc.result)
+		}
+	}
+
+	var iErr InputError
+	err := mgr.InitializeModules(map[string]ModuleSpec{"bad": {Source: "fake", DefaultAction: "nope"}}, false)
+	if !errors.As(err, &iErr) {
+		t.Errorf("an unknown default_action got %v, want an InputError", err)
+	}
+}
+
+func TestListModules(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"zeta":  fakeSpec(""),
+		"alpha": {Source: "echo", Config: json.RawMessage(`{}`)},
+		"mid":   {Source: "fake_default", Config: json.RawMessage(`{}`)},
+	})
+	srv := newTestServer(t, mgr)
+	want := []ModuleListing{{"alpha", "echo"}, {"mid", "fake_default"}, {"zeta", "fake"}}
+
+	// map iteration is random, so ask a few times
+	for i := 0; i < 5; i++ {
+		resp, err := http.Get(srv.URL + "/modules")
+		if err != nil {
+			t.Fatalf("GET /modules failed: %v", err)
+		}
+		var listing []ModuleListing
+		err = json.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed decoding listing: %v", err)
+		}
+		if !reflect.DeepEqual(listing, want) {
+			t.Fatalf("got %+v, want %+v", listing, want)
+		}
+	}
+}
+
+func TestActNotFound(t *testing.T) {
+	testPin(t, "NOT_FOUND_PIN")
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"a":     fakeSpec(""),
+		"relay": {Source: "relay", Config: json.RawMessage(`{"pin": "NOT_FOUND_PIN"}`)},
+	})
+	srv := newTestServer(t, mgr)
+
+	for _, tc := range []struct {
+		module, action string
+		message        string
+	}{
+		{"nope", "read", "no such module `nope`"},
+		{"a", "nope", "no such action `nope`"},
+		{"relay", "nope", "no such action `nope`"},
+	} {
+		var nfErr NotFoundError
+		if _, err := mgr.Act(tc.module, tc.action, mgr.Binder(nil)); !errors.As(err, &nfErr) {
+			t.Errorf("%s/%s: got %v, want a NotFoundError", tc.module, tc.action, err)
+		}
+
+		resp, body := post(t, srv, "/act", `{"module": "`+tc.module+`", "action": "`+tc.action+`"}`)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s/%s: got status %d, want 404", tc.module, tc.action, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tc.message) {
+			t.Errorf("%s/%s: got %s, want %q", tc.module, tc.action, body, tc.message)
+		}
+	}
+}
+
+func TestActTimeout(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	for _, tc := range []struct {
+		timeout string
+		ms      int
+		status  int
+	}{
+		{"50ms", 1000, http.StatusGatewayTimeout},
+		{"1s", 5, http.StatusOK},
+		{"", 5, http.StatusOK},
+		{"soon", 5, http.StatusBadRequest},
+		{"-1s", 5, http.StatusBadRequest},
+	} {
+		body := fmt.Sprintf(`{"module": "a", "action": "sleep", "config": {"ms": %d}}`, tc.ms)
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/act", strings.NewReader(body))
+		if tc.timeout != "" {
+			req.Header.Set(ActTimeoutHeader, tc.timeout)
+		}
+
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("POST /act failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("timeout %q: got status %d, want %d", tc.timeout, resp.StatusCode, tc.status)
+		}
+		if elapsed := time.Since(start); tc.status == http.StatusGatewayTimeout && elapsed > 500*time.Millisecond {
+			t.Errorf("timeout %q: took %s to give up", tc.timeout, elapsed)
+		}
+	}
+}
+
+func TestBatchActOrderingAndStopOnError(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"a": fakeSpec(`{"value": 1}`),
+		"b": fakeSpec(`{"value": 2}`),
+	})
+	srv := newTestServer(t, mgr)
+
+	actions := `[
+		{"module": "a", "action": "read"},
+		{"module": "b", "action": "fail", "config": {"kind": "input"}},
+		{"module": "b", "action": "read"}
+	]`
+	for _, tc := range []struct {
+		stopOnError bool
+		want        []BatchActResult
+	}{
+		{false, []BatchActResult{{Result: 1.0}, {Error: &BatchActError{Code: http.StatusBadRequest}}, {Result: 2.0}}},
+		{true, []BatchActResult{{Result: 1.0}, {Error: &BatchActError{Code: http.StatusBadRequest}}}},
+	} {
+		resp, body := post(t, srv, "/act/batch", fmt.Sprintf(`{"actions": %s, "stop_on_error": %v}`, actions, tc.stopOnError))
+		var batch BatchActResponse
+		if err := json.Unmarshal(body, &batch); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("stop_on_error %v: got status %d and %s", tc.stopOnError, resp.StatusCode, body)
+		}
+		for _, result := range batch.Results {
+			if result.Error != nil {
+				result.Error.Message = ""
+			}
+		}
+		if !reflect.DeepEqual(batch.Results, tc.want) {
+			t.Errorf("stop_on_error %v: got %s", tc.stopOnError, body)
+		}
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		source    string
+		busBroken bool
+		status    int
+	}{
+		{"healthy", "fake_i2c", false, http.StatusOK},
+		{"no bus, not needed", "fake", true, http.StatusOK},
+		{"no bus, needed", "fake_i2c", true, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sp := &ServiceAgent{defaultI2CBus: &i2ctest.Playback{}}
+			mgr := newTestManager()
+			mgr.ServiceProvider = sp
+			mustInitialize(t, mgr, map[string]ModuleSpec{"a": {Source: tc.source, Config: json.RawMessage(`{}`)}})
+			if tc.busBroken {
+				sp.defaultI2CBus, sp.i2cErr = nil, errors.New("no such bus")
+			}
+			srv := newTestServer(t, mgr)
+
+			resp, err := http.Get(srv.URL + "/healthz")
+			if err != nil {
+				t.Fatalf("GET /healthz failed: %v", err)
+			}
+			defer resp.Body.Close()
+			var health HealthzResponse
+			if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+				t.Fatalf("failed decoding /healthz: %v", err)
+			}
+
+			want := HealthzResponse{I2CBus: !tc.busBroken, Modules: 1}
+			if tc.busBroken {
+				want.I2CError = "no such bus"
+			}
+			if resp.StatusCode != tc.status || health != want {
+				t.Errorf("got status %d and %+v, want %d and %+v", resp.StatusCode, health, tc.status, want)
+			}
+		})
+	}
+}
+
+func TestStrictBinding(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		mgr := newTestManager()
+		mgr.StrictBinding = strict
+		srv := newTestServer(t, mgr)
+		mustInitialize(t, mgr, map[string]ModuleSpec{"echo": {Source: "echo", Config: json.RawMessage(`{}`)}})
+
+		for _, tc := range []struct {
+			path, body string
+			strictOK   bool
+		}{
+			{"/initialize", `{"modules": {"a": {"source": "fake", "config": {"value": 1}}}}`, true},
+			{"/initialize", `{"modules": {"b": {"source": "fake", "config": {"valeu": 1}}}}`, false},
+			{"/act", `{"module": "a", "action": "sleep", "config": {"ms": 1}}`, true},
+			{"/act", `{"module": "a", "action": "sleep", "config": {"ms": 1, "seconds": 1}}`, false},
+			// the echo module binds whatever it's sent
+			{"/act", `{"module": "echo", "action": "any", "config": {"whatever": 1}}`, true},
+		} {
+			want := http.StatusOK
+			if strict && !tc.strictOK {
+				want = http.StatusBadRequest
+			}
+			if resp, body := post(t, srv, tc.path, tc.body); resp.StatusCode != want {
+				t.Errorf("strict %v: %s %s got status %d, want %d: %s", strict, tc.path, tc.body, resp.StatusCode, want, body)
+			}
+		}
+	}
+}
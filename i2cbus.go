@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+)
+
+const (
+	// I2CReconnectFailures is the number of consecutive failed transactions
+	// after which the bus is closed and reopened.
+	I2CReconnectFailures = 5
+
+	i2cMinReconnectBackoff = time.Second
+	i2cMaxReconnectBackoff = time.Minute
+)
+
+// ErrI2CBusUnavailable is returned while the bus is closed because reopening
+// it failed, until a later attempt succeeds.
+var ErrI2CBusUnavailable = errors.New("i2c bus unavailable")
+
+// reconnectingBus wraps the default I2C bus so that modules sharing it can
+// recover from a wedged bus (e.g. after a brown-out). Once a run of
+// transactions has failed, it reopens the underlying bus, backing off
+// exponentially between attempts while the bus stays broken.
+type reconnectingBus struct {
+	open   func() (i2c.BusCloser, error)
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// bus is nil while reopening it is failing
+	bus         i2c.BusCloser
+	failures    int
+	backoff     time.Duration
+	nextAttempt time.Time
+	lastErr     error
+}
+
+func newReconnectingBus(bus i2c.BusCloser, open func() (i2c.BusCloser, error), logger *slog.Logger) *reconnectingBus {
+	return &reconnectingBus{
+		open:    open,
+		logger:  logger,
+		bus:     bus,
+		backoff: i2cMinReconnectBackoff,
+	}
+}
+
+func (b *reconnectingBus) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bus == nil {
+		return "i2c (unavailable)"
+	}
+	return b.bus.String()
+}
+
+func (b *reconnectingBus) Tx(addr uint16, w, r []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.bus == nil {
+		if !time.Now().Before(b.nextAttempt) {
+			b.reconnect()
+		}
+		if b.bus == nil {
+			return ErrI2CBusUnavailable
+		}
+	}
+
+	err := b.bus.Tx(addr, w, r)
+	if err == nil {
+		b.failures = 0
+		return nil
+	}
+	b.lastErr = err
+
+	b.failures++
+	if b.failures >= I2CReconnectFailures && !time.Now().Before(b.nextAttempt) {
+		b.reconnect()
+	}
+	return err
+}
+
+func (b *reconnectingBus) SetSpeed(f physic.Frequency) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bus == nil {
+		return ErrI2CBusUnavailable
+	}
+	return b.bus.SetSpeed(f)
+}
+
+func (b *reconnectingBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bus == nil {
+		return nil
+	}
+	err := b.bus.Close()
+	b.bus = nil
+	return err
+}
+
+// Healthy reports whether the bus is working, i.e. hasn't failed enough
+// transactions in a row to need reconnecting, along with the last failure.
+func (b *reconnectingBus) Healthy() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < I2CReconnectFailures {
+		return true, nil
+	}
+	return false, b.lastErr
+}
+
+// reconnect must be called with b.mu held. If reopening fails, b.bus is left
+// nil until a later attempt succeeds.
+func (b *reconnectingBus) reconnect() {
+	b.logger.Warn("attempting to reopen i2c bus", "consecutive_failures", b.failures)
+
+	if b.bus != nil {
+		_ = b.bus.Close()
+		b.bus = nil
+	}
+	bus, err := b.open()
+	if err != nil {
+		b.logger.Error("failed reopening i2c bus", "error", err, "retry_in", b.backoff)
+		b.lastErr = err
+		b.nextAttempt = time.Now().Add(b.backoff)
+		b.backoff *= 2
+		if b.backoff > i2cMaxReconnectBackoff {
+			b.backoff = i2cMaxReconnectBackoff
+		}
+		return
+	}
+
+	b.logger.Info("reopened i2c bus")
+	b.bus = bus
+	b.failures = 0
+	b.backoff = i2cMinReconnectBackoff
+	b.nextAttempt = time.Time{}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/physic"
+)
+
+// fakeBus is an I2C bus that fails every transaction while broken.
+type fakeBus struct {
+	broken bool
+	closed bool
+	txs    int
+}
+
+func (*fakeBus) String() string                  { return "fake" }
+func (*fakeBus) SetSpeed(physic.Frequency) error { return nil }
+func (*fakeBus) SCL() gpio.PinIO                 { return gpio.INVALID }
+func (*fakeBus) SDA() gpio.PinIO                 { return gpio.INVALID }
+func (b *fakeBus) Close() error {
+	b.closed = true
+	return nil
+}
+func (b *fakeBus) Tx(addr uint16, w, r []byte) error {
+	b.txs++
+	if b.broken {
+		return errors.New("bus is wedged")
+	}
+	return nil
+}
+
+func TestReconnectingBusRecovers(t *testing.T) {
+	wedged := &fakeBus{broken: true}
+	var opened []*fakeBus
+	openFails := true
+	bus := newReconnectingBus(wedged, func() (i2c.BusCloser, error) {
+		if openFails {
+			return nil, errors.New("no bus yet")
+		}
+		fresh := &fakeBus{}
+		opened = append(opened, fresh)
+		return fresh, nil
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	for i := 0; i < I2CReconnectFailures; i++ {
+		if healthy, _ := bus.Healthy(); !healthy {
+			t.Fatalf("unhealthy after %d failures", i)
+		}
+		if err := bus.Tx(0x40, []byte{1}, nil); err == nil {
+			t.Fatal("a transaction on a wedged bus succeeded")
+		}
+	}
+	if !wedged.closed {
+		t.Error("the wedged bus wasn't closed")
+	}
+	if healthy, err := bus.Healthy(); healthy || err == nil {
+		t.Errorf("got healthy %v, %v after a failed reopen", healthy, err)
+	}
+	if bus.backoff != 2*i2cMinReconnectBackoff {
+		t.Errorf("got backoff %s after one failed reopen", bus.backoff)
+	}
+
+	// the closed bus isn't used while reopens wait out the backoff
+	openFails = false
+	txs := wedged.txs
+	if err := bus.Tx(0x40, []byte{1}, nil); !errors.Is(err, ErrI2CBusUnavailable) {
+		t.Errorf("got %v while the bus was unavailable, want ErrI2CBusUnavailable", err)
+	}
+	if wedged.txs != txs {
+		t.Error("a transaction went to the closed bus")
+	}
+	if len(opened) != 0 {
+		t.Fatal("reopened the bus before the backoff elapsed")
+	}
+
+	bus.nextAttempt = time.Now()
+	if err := bus.Tx(0x40, []byte{1}, nil); err != nil {
+		t.Errorf("transaction after reopening failed: %v", err)
+	}
+	if len(opened) != 1 {
+		t.Fatalf("got %d reopens after the backoff elapsed, want 1", len(opened))
+	}
+	if opened[0].txs != 1 {
+		t.Errorf("the reopened bus got %d transactions, want 1", opened[0].txs)
+	}
+	if healthy, _ := bus.Healthy(); !healthy || bus.backoff != i2cMinReconnectBackoff {
+		t.Errorf("got healthy %v and backoff %s after reopening", healthy, bus.backoff)
+	}
+}
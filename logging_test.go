@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	for _, tc := range []struct {
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{"debug", slog.LevelDebug, false},
+		{"INFO", slog.LevelInfo, false},
+		{"warn", slog.LevelWarn, false},
+		{"error", slog.LevelError, false},
+		{"loud", 0, true},
+	} {
+		got, err := ParseLogLevel(tc.level)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("%q: got %s, %v, want %s, error: %v", tc.level, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestActErrorsAreLogged(t *testing.T) {
+	var logs bytes.Buffer
+	mgr := newTestManager()
+	mgr.Logger = slog.New(requestIDHandler{slog.NewJSONHandler(&logs, nil)})
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	for _, tc := range []struct {
+		kind  string
+		level string
+	}{
+		{"internal", "ERROR"},
+		// a failure the client can fix is only a warning
+		{"input", "WARN"},
+	} {
+		logs.Reset()
+		resp, _ := post(t, srv, "/act", `{"module": "a", "action": "fail", "config": {"kind": "`+tc.kind+`"}}`)
+
+		var record struct {
+			Level     string `json:"level"`
+			Msg       string `json:"msg"`
+			Module    string `json:"module"`
+			Action    string `json:"action"`
+			RequestID string `json:"request_id"`
+		}
+		if err := json.Unmarshal(logs.Bytes(), &record); err != nil {
+			t.Fatalf("%s: failed decoding log %s: %v", tc.kind, logs.Bytes(), err)
+		}
+		if record.Level != tc.level || record.Msg != "action failed" || record.Module != "a" || record.Action != "fail" {
+			t.Errorf("%s: got log record %+v", tc.kind, record)
+		}
+		if id := resp.Header.Get(RequestIDHeader); id == "" || record.RequestID != id {
+			t.Errorf("%s: got request_id %q, want %q", tc.kind, record.RequestID, id)
+		}
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	var seen string
+	handler := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	for _, tc := range []struct {
+		name     string
+		supplied string
+		kept     bool
+	}{
+		{"generated", "", false},
+		{"echoed", "client-id-42", true},
+		{"unprintable", "bad\nid", false},
+		{"too long", strings.Repeat("x", maxRequestIDLength+1), false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/modules", nil)
+		if tc.supplied != "" {
+			req.Header.Set(RequestIDHeader, tc.supplied)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		id := rec.Header().Get(RequestIDHeader)
+		if id != seen {
+			t.Errorf("%s: responded with id %q, but the handler saw %q", tc.name, id, seen)
+		}
+		if tc.kept && id != tc.supplied || !tc.kept && !uuid.MatchString(id) {
+			t.Errorf("%s: got id %q for supplied id %q", tc.name, id, tc.supplied)
+		}
+	}
+}
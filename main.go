@@ -2,20 +2,35 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
 
+	"periph.io/x/periph"
 	"periph.io/x/periph/conn/gpio"
 	"periph.io/x/periph/conn/gpio/gpioreg"
 	"periph.io/x/periph/conn/i2c"
 	"periph.io/x/periph/conn/i2c/i2creg"
+	"periph.io/x/periph/conn/spi"
 	"periph.io/x/periph/host"
 
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 ////////////////////////
@@ -29,88 +44,1620 @@ type Module interface {
 
 type ModuleFactory func() Module
 
+// SubsystemUser is implemented by modules that depend on a hardware
+// subsystem. InitializeModules refuses to build them when the
+// ServiceProvider doesn't have that subsystem available.
+type SubsystemUser interface {
+	Requires() []string
+}
+
+const (
+	SubsystemGPIO = "gpio"
+	SubsystemI2C  = "i2c"
+	SubsystemSPI  = "spi"
+)
+
+// PinUser is implemented by modules that claim pins or bus addresses, so
+// the ManagerAgent can report what each module is using.
+type PinUser interface {
+	Pins() []string
+}
+
+// LoggerUser is implemented by modules that log. They're given a logger
+// tagged with their module name before Initialize.
+type LoggerUser interface {
+	SetLogger(logger *slog.Logger)
+}
+
+// Actioner is implemented by modules that know their action names up front,
+// so that the ManagerAgent can reject unknown actions before calling Act.
+// Modules that implement Describer needn't implement it too.
+type Actioner interface {
+	Actions() []string
+}
+
+// actionsOf lists mod's actions, if it says what they are.
+func actionsOf(mod Module) ([]string, bool) {
+	if a, ok := mod.(Actioner); ok {
+		return a.Actions(), true
+	}
+	if d, ok := mod.(Describer); ok {
+		descriptor := d.Describe()
+		if descriptor.AnyAction {
+			return nil, false
+		}
+		names := make([]string, len(descriptor.Actions))
+		for i, action := range descriptor.Actions {
+			names[i] = action.Name
+		}
+		return names, true
+	}
+	return nil, false
+}
+
+// checkAction returns a NotFoundError listing mod's actions if it doesn't
+// have the named one. Modules that don't list their actions are left to
+// reject unknown ones themselves.
+func checkAction(mod Module, action string) error {
+	names, ok := actionsOf(mod)
+	if !ok {
+		return nil
+	}
+	for _, name := range names {
+		if name == action {
+			return nil
+		}
+	}
+
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	return NotFoundError{error: fmt.Errorf("no such action `%s`, expected one of: %s", action, strings.Join(sorted, ", "))}
+}
+
+// DefaultActioner is implemented by modules with a natural action, usually
+// their main reading, that is performed when a request names no action. A
+// ModuleSpec's default_action takes precedence over it.
+type DefaultActioner interface {
+	DefaultAction() string
+}
+
+// Warmer is implemented by modules whose readings aren't valid until some
+// time after Initialize, e.g. gas sensors with a heater. A ModuleSpec's
+// warmup_seconds takes precedence over it.
+type Warmer interface {
+	Warmup() time.Duration
+}
+
+// WarmupError is returned for any action on a module that is still warming
+// up.
+type WarmupError struct {
+	Module    string
+	Remaining time.Duration
+}
+
+func (e WarmupError) Error() string {
+	return fmt.Sprintf("module `%s` is warming up, ready in %s", e.Module, e.Remaining.Round(time.Second))
+}
+
+// RestartingError is returned for any action on a module that is being
+// restarted.
+type RestartingError struct {
+	Module string
+}
+
+func (e RestartingError) Error() string {
+	return fmt.Sprintf("module `%s` is restarting", e.Module)
+}
+
+// RateLimitError is returned by a module asked to act again too soon after
+// its last action.
+type RateLimitError struct {
+	Remaining time.Duration
+}
+
+func (e RateLimitError) Error() string {
+	return fmt.Sprintf("acting too often, try again in %s", e.Remaining.Round(time.Millisecond))
+}
+
+// TimeoutError is returned when an action doesn't finish within its
+// request's deadline.
+type TimeoutError struct {
+	Module  string
+	Action  string
+	Timeout time.Duration
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("action `%s` on module `%s` did not finish within %s", e.Action, e.Module, e.Timeout)
+}
+
+// PinRebinder is implemented by modules that can move to a different GPIO
+// pin without being rebuilt. The ManagerAgent exposes this as the
+// "rebind_pin" action. PinRebinders should also be ConfigSnapshotters, so
+// that the new pin outlives a restart.
+type PinRebinder interface {
+	RebindPin(sp ServiceProvider, name string) error
+}
+
+const RebindPinAction = "rebind_pin"
+
+type RebindPinRequest struct {
+	Pin string `json:"pin"`
+}
+
+func (r RebindPinRequest) Validate() error {
+	if r.Pin == "" {
+		return errors.New("pin is required")
+	}
+	return nil
+}
+
 var ModuleIndex = map[string]ModuleFactory{
 	"echo":      func() Module { return &EchoModule{} },
 	"relay":     func() Module { return &RelayModule{} },
 	"htg3535ch": func() Module { return &HTGModule{} },
 	"i2c":       func() Module { return &I2CModule{} },
 	"ads":       func() Module { return &ADS1115Module{} },
+	"rgbled":    func() Module { return &RGBLEDModule{} },
+	"input":     func() Module { return &GPIOInputModule{} },
+	"stepper":   func() Module { return &StepperModule{} },
+	"pca9685":   func() Module { return &PCA9685Module{} },
+	"bme280":    func() Module { return &BME280Module{} },
+	"pir":       func() Module { return &PIRModule{} },
+	"spi":       func() Module { return &SPIModule{} },
+	"mcp3008":   func() Module { return &MCP3008Module{} },
+}
+
+// RestartAction is a pseudo-action handled by the ManagerAgent itself rather
+// than the module. It stops the module and rebuilds it from its stored spec.
+const RestartAction = "__restart"
+
+// BenchmarkAction is a pseudo-action that times repeated calls to one of the
+// module's real actions, to help choose a feasible polling interval.
+const BenchmarkAction = "__benchmark"
+
+// DefaultMaxModules caps the number of live modules unless overridden with
+// PIHUB_MAX_MODULES.
+const DefaultMaxModules = 64
+
+// InitializeModules adds the modules in specs, stopping and replacing any
+// live module of the same name unless its spec is unchanged. With replace,
+// live modules missing from specs are stopped and removed as well, so that
+// the hub runs exactly specs.
+func (a *ManagerAgent) InitializeModules(specs map[string]ModuleSpec, replace bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if replace {
+		// validate before stopping anything
+		if _, err := a.validateSpecs(specs, nil); err != nil {
+			return err
+		}
+		for name := range a.Modules {
+			if _, ok := specs[name]; !ok {
+				a.stopModule(name)
+			}
+		}
+	}
+
+	if err := a.initializeModules(specs); err != nil {
+		return err
+	}
+
+	a.logModuleSummary()
+	return nil
+}
+
+// initializeModules must be called with a.mu held.
+func (a *ManagerAgent) initializeModules(specs map[string]ModuleSpec) error {
+	order, err := a.validateSpecs(specs, a.Modules)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		spec := specs[name]
+
+		// the old module has to let go of its hardware before the new one
+		// can have it, so it's stopped first and rebuilt if the new one fails
+		previous, replacing := a.Specs[name]
+		if _, ok := a.Modules[name]; ok {
+			if sameSpec(previous, spec) {
+				continue
+			}
+			a.stopModule(name)
+		}
+
+		mod, err := a.buildModule(name, spec)
+		if err != nil {
+			if replacing {
+				a.rebuildModule(name, previous)
+			}
+			return err
+		}
+		a.addModule(name, spec, mod)
+	}
+	return nil
+}
+
+// rebuildModule puts back a module that was stopped to be replaced, after
+// its replacement failed. The caller must hold a.mu.
+func (a *ManagerAgent) rebuildModule(name string, spec ModuleSpec) {
+	mod, err := a.buildModule(name, spec)
+	if err != nil {
+		a.Logger.Error("failed rebuilding replaced module", "module", name, "error", err)
+		return
+	}
+	a.addModule(name, spec, mod)
+}
+
+// sameSpec reports whether two specs build the same module.
+func sameSpec(x, y ModuleSpec) bool {
+	xs, xErr := json.Marshal(x)
+	ys, yErr := json.Marshal(y)
+	return xErr == nil && yErr == nil && bytes.Equal(xs, ys)
+}
+
+// InitializeEach is a forgiving InitializeModules for reloading saved
+// state. Rather than stopping at the first failure, it leaves out each
+// module that fails, along with any module that depends on it, and reports
+// the failures by module name.
+func (a *ManagerAgent) InitializeEach(specs map[string]ModuleSpec) map[string]error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	failed := map[string]error{}
+	valid := map[string]ModuleSpec{}
+	for name, spec := range specs {
+		if err := validateSpec(name, spec); err != nil {
+			failed[name] = err
+			continue
+		}
+		valid[name] = spec
+	}
+
+	// leave out each module with a bad dependency until the rest can be
+	// ordered
+	var order []string
+	for {
+		dropFailedDependents(valid, failed)
+
+		var err error
+		order, err = initializationOrder(valid, a.Modules)
+		if err == nil {
+			break
+		}
+		var sErr moduleSpecError
+		if !errors.As(err, &sErr) {
+			for name := range valid {
+				failed[name] = err
+			}
+			return failed
+		}
+		failed[sErr.Module] = sErr
+		delete(valid, sErr.Module)
+	}
+
+	for _, name := range order {
+		spec := specs[name]
+		if dep := failedDependency(spec, failed); dep != "" {
+			failed[name] = fmt.Errorf("dependency `%s` failed to initialize", dep)
+			continue
+		}
+		if _, ok := a.Modules[name]; !ok && len(a.Modules) >= a.MaxModules {
+			failed[name] = fmt.Errorf("initializing this module would exceed the limit of %d modules", a.MaxModules)
+			continue
+		}
+
+		mod, err := a.buildModule(name, spec)
+		if err != nil {
+			failed[name] = err
+			continue
+		}
+		a.addModule(name, spec, mod)
+	}
+
+	a.logModuleSummary()
+	return failed
+}
+
+// dropFailedDependents moves every spec depending, even indirectly, on a
+// failed module from specs to failed.
+func dropFailedDependents(specs map[string]ModuleSpec, failed map[string]error) {
+	for changed := true; changed; {
+		changed = false
+		for name, spec := range specs {
+			if dep := failedDependency(spec, failed); dep != "" {
+				failed[name] = fmt.Errorf("dependency `%s` failed to initialize", dep)
+				delete(specs, name)
+				changed = true
+			}
+		}
+	}
+}
+
+func failedDependency(spec ModuleSpec, failed map[string]error) string {
+	for _, dep := range spec.DependsOn {
+		if _, ok := failed[dep]; ok {
+			return dep
+		}
+	}
+	return ""
+}
+
+// addModule records a freshly built module. The caller must hold a.mu.
+func (a *ManagerAgent) addModule(name string, spec ModuleSpec, mod Module) {
+	a.Modules[name] = mod
+	a.Specs[name] = spec
+	a.startWarmup(name, spec, mod)
+
+	delete(a.anomalies, name)
+	if spec.Anomaly != nil {
+		a.anomalies[name] = newAnomalyDetector(*spec.Anomaly)
+	}
+}
+
+// validateSpecs checks everything about specs that can be checked without
+// touching hardware, assuming live are the modules they will be added to,
+// and returns the order to initialize them in. Its errors are InputErrors,
+// since they're all the fault of the specs.
+func (a *ManagerAgent) validateSpecs(specs map[string]ModuleSpec, live map[string]Module) ([]string, error) {
+	total := len(live)
+	for name := range specs {
+		if _, ok := live[name]; !ok {
+			total++
+		}
+	}
+	if total > a.MaxModules {
+		return nil, InputError{error: fmt.Errorf("initializing these modules would bring the total to %d, exceeding the limit of %d", total, a.MaxModules)}
+	}
+
+	for name, spec := range specs {
+		if err := validateSpec(name, spec); err != nil {
+			return nil, InputError{error: err}
+		}
+	}
+
+	order, err := initializationOrder(specs, live)
+	if err != nil {
+		return nil, InputError{error: err}
+	}
+	return order, nil
 }
 
-func (a *ManagerAgent) InitializeModules(specs map[string]ModuleSpec) error {
-	for name, spec := range specs {
-		if factory, ok := ModuleIndex[spec.Source]; ok {
-			a.Modules[name] = factory()
-			binder := &JSONBinder{requestBody: bytes.NewBuffer([]byte(spec.Config))}
-			if err := a.Modules[name].Initialize(a.ServiceProvider, binder); err != nil {
-				return fmt.Errorf("failed to initialize module: %w", err)
+// validateSpec checks everything about a single spec, leaving aside its
+// dependencies, that can be checked without touching hardware.
+func validateSpec(name string, spec ModuleSpec) error {
+	if _, ok := ModuleIndex[spec.Source]; !ok {
+		return fmt.Errorf("404 no such module source: %s", spec.Source)
+	}
+	if spec.Anomaly != nil {
+		if err := spec.Anomaly.Validate(); err != nil {
+			return fmt.Errorf("invalid anomaly config for module `%s`: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// moduleSpecError blames a failure to order modules on one of them.
+type moduleSpecError struct {
+	Module string
+	error
+}
+
+// initializationOrder sorts the names in specs so that every module comes
+// after the modules it depends on. Dependencies may also name modules that
+// are already live.
+func initializationOrder(specs map[string]ModuleSpec, live map[string]Module) ([]string, error) {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := map[string]int{}
+	order := make([]string, 0, len(specs))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			return moduleSpecError{Module: name, error: fmt.Errorf("module dependency cycle: %s", strings.Join(append(path, name), " -> "))}
+		}
+
+		state[name] = visiting
+		for _, dep := range specs[name].DependsOn {
+			if _, ok := specs[dep]; !ok {
+				if _, ok := live[dep]; ok {
+					continue
+				}
+				return moduleSpecError{Module: name, error: fmt.Errorf("module `%s` depends on unknown module `%s`", name, dep)}
+			}
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// logModuleSummary prints every live module along with its source and the
+// pins it claimed.
+func (a *ManagerAgent) logModuleSummary() {
+	names := make([]string, 0, len(a.Modules))
+	for name := range a.Modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	a.Logger.Info("modules initialized", "count", len(names))
+	for _, name := range names {
+		pins := "none"
+		if user, ok := a.Modules[name].(PinUser); ok {
+			pins = strings.Join(user.Pins(), ",")
+		}
+		a.Logger.Info("module initialized", "module", name, "source", a.Specs[name].Source, "pins", pins)
+	}
+}
+func (a *ManagerAgent) buildModule(name string, spec ModuleSpec) (Module, error) {
+	factory, ok := ModuleIndex[spec.Source]
+	if !ok {
+		return nil, fmt.Errorf("404 no such module source: %s", spec.Source)
+	}
+
+	mod := factory()
+	if spec.DefaultAction != "" {
+		if err := checkAction(mod, spec.DefaultAction); err != nil {
+			return nil, InputError{error: fmt.Errorf("invalid default_action: %w", err)}
+		}
+	}
+	if user, ok := mod.(SubsystemUser); ok {
+		available := map[string]bool{}
+		for _, subsystem := range a.ServiceProvider.Subsystems() {
+			available[subsystem] = true
+		}
+		for _, subsystem := range user.Requires() {
+			if !available[subsystem] {
+				return nil, fmt.Errorf("module source `%s` requires the %s subsystem, which is not available", spec.Source, subsystem)
+			}
+		}
+	}
+
+	if user, ok := mod.(LoggerUser); ok {
+		user.SetLogger(a.Logger.With("module", name))
+	}
+
+	binder := a.Binder(spec.Config)
+	if err := mod.Initialize(a.ServiceProvider, binder); err != nil {
+		return nil, fmt.Errorf("failed to initialize module: %w", err)
+	}
+	return mod, nil
+}
+func (a *ManagerAgent) Act(module string, action string, binder Binder) (interface{}, error) {
+	if action == RestartAction {
+		if err := a.RestartModule(module); err != nil {
+			return nil, err
+		}
+		return RestartResponse{Restarted: true}, nil
+	}
+
+	if action == BenchmarkAction {
+		return a.benchmark(module, binder)
+	}
+	if action == RebindPinAction {
+		if handled, err := a.rebindPin(module, binder); handled {
+			if err != nil {
+				return nil, err
+			}
+			return RebindPinResponse{Rebound: true}, nil
+		}
+	}
+
+	result, changed, err := a.act(module, action, binder)
+	if changed && a.OnConfigChange != nil {
+		a.OnConfigChange()
+	}
+	return result, err
+}
+
+// act performs one of a module's own actions, and reports whether it
+// changed the module's config.
+func (a *ManagerAgent) act(module string, action string, binder Binder) (interface{}, bool, error) {
+	mod, action, detector, err := a.resolve(module, action)
+	if err != nil {
+		return nil, false, err
+	}
+
+	result, err := mod.Act(action, binder)
+	if err != nil {
+		return nil, false, err
+	}
+	changer, ok := mod.(ConfigChanger)
+	changed := ok && changer.ChangesConfig(action)
+	if changed {
+		a.refreshSpec(module, mod)
+	}
+
+	if detector != nil {
+		if val, ok := result.(float64); ok {
+			return detector.Observe(action, val), changed, nil
+		}
+	}
+	return result, changed, nil
+}
+
+// resolve looks up the module and action to perform, along with the
+// module's anomaly detector if it has one. a.mu is only held for the lookup,
+// so that a slow action on one module doesn't hold up changes to the others.
+func (a *ManagerAgent) resolve(module string, action string) (Module, string, *anomalyDetector, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	mod, ok := a.Modules[module]
+	if !ok {
+		return nil, "", nil, NotFoundError{error: fmt.Errorf("no such module `%s`", module)}
+	}
+	if a.restarting[module] {
+		return nil, "", nil, RestartingError{Module: module}
+	}
+	if action == "" {
+		if action = a.defaultAction(module); action == "" {
+			return nil, "", nil, InputError{error: fmt.Errorf("no action given and module `%s` has no default action", module)}
+		}
+	}
+	if err := checkAction(mod, action); err != nil {
+		return nil, "", nil, err
+	}
+	if remaining := time.Until(a.readyAt[module]); remaining > 0 {
+		return nil, "", nil, WarmupError{Module: module, Remaining: remaining}
+	}
+	return mod, action, a.anomalies[module], nil
+}
+
+// MetricLabels returns the module and action names to record a request's
+// metrics under. A module that isn't live, or an action it doesn't list, is
+// UnknownMetricLabel.
+func (a *ManagerAgent) MetricLabels(module string, action string) (string, string) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	mod, ok := a.Modules[module]
+	if !ok {
+		return UnknownMetricLabel, UnknownMetricLabel
+	}
+	switch action {
+	case RestartAction, BenchmarkAction, RebindPinAction:
+		return module, action
+	case "":
+		action = a.defaultAction(module)
+	}
+
+	names, _ := actionsOf(mod)
+	for _, name := range names {
+		if name == action {
+			return module, action
+		}
+	}
+	return module, UnknownMetricLabel
+}
+
+// defaultAction resolves the action to perform when a request doesn't name
+// one. The caller must hold a.mu.
+func (a *ManagerAgent) defaultAction(module string) string {
+	if action := a.Specs[module].DefaultAction; action != "" {
+		return action
+	}
+	if d, ok := a.Modules[module].(DefaultActioner); ok {
+		return d.DefaultAction()
+	}
+	return ""
+}
+
+// benchmark runs the requested action, or the module's default action,
+// repeatedly, discarding the results, and reports how long each call took.
+func (a *ManagerAgent) benchmark(module string, binder Binder) (interface{}, error) {
+	var request = &BenchmarkRequest{}
+	if err := binder.BindData(request); err != nil {
+		return nil, err
+	}
+
+	mod, action, _, err := a.resolve(module, request.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	durations := make([]time.Duration, request.Iterations)
+	for i := range durations {
+		start := time.Now()
+		if _, err := mod.Act(action, a.Binder(request.Config)); err != nil {
+			return nil, fmt.Errorf("benchmark iteration %d failed: %w", i, err)
+		}
+		durations[i] = time.Since(start)
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	p95 := durations[int(math.Ceil(0.95*float64(len(durations))))-1]
+
+	return BenchmarkResponse{
+		Iterations: request.Iterations,
+		MinMS:      millis(durations[0]),
+		MaxMS:      millis(durations[len(durations)-1]),
+		MeanMS:     millis(total / time.Duration(len(durations))),
+		P95MS:      millis(p95),
+	}, nil
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// rebindPin moves a PinRebinder module onto a new pin, refusing pins that
+// another module has already claimed. It reports whether the module was a
+// PinRebinder at all, so other modules can still handle the action name.
+func (a *ManagerAgent) rebindPin(module string, binder Binder) (bool, error) {
+	// rebinds are serialized so that two can't claim the same pin, but a.mu
+	// is only held while checking claims, so that a module busy with a long
+	// action doesn't hold up the others
+	a.rebindMu.Lock()
+	defer a.rebindMu.Unlock()
+
+	a.mu.RLock()
+	rebinder, ok := a.Modules[module].(PinRebinder)
+	restarting := a.restarting[module]
+	a.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	if restarting {
+		return true, RestartingError{Module: module}
+	}
+
+	var request = &RebindPinRequest{}
+	if err := binder.BindData(request); err != nil {
+		return true, err
+	}
+
+	pin, err := a.ServiceProvider.GetGPIOByName(request.Pin)
+	if err != nil {
+		return true, err
+	}
+	if pin == nil {
+		return true, InputError{error: fmt.Errorf("Failed to find pin `%s`", request.Pin)}
+	}
+
+	if err := a.checkPinUnclaimed(module, realPinName(pin)); err != nil {
+		return true, err
+	}
+	if err := rebinder.RebindPin(a.ServiceProvider, request.Pin); err != nil {
+		return true, err
+	}
+
+	a.refreshSpec(module, rebinder)
+	if a.OnConfigChange != nil {
+		a.OnConfigChange()
+	}
+	return true, nil
+}
+
+// refreshSpec replaces the stored config of a ConfigSnapshotter with its
+// current one, so that a restart rebuilds it as it is now rather than as it
+// was first initialized.
+func (a *ManagerAgent) refreshSpec(name string, mod interface{}) {
+	s, ok := mod.(ConfigSnapshotter)
+	if !ok {
+		return
+	}
+	config, err := json.Marshal(s.SnapshotConfig())
+	if err != nil {
+		a.Logger.Error("failed snapshotting module", "module", name, "error", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// it may have been stopped or replaced in the meantime
+	if live, ok := a.Modules[name]; ok && live == mod {
+		spec := a.Specs[name]
+		spec.Config = config
+		a.Specs[name] = spec
+	}
+}
+
+// checkPinUnclaimed fails if any module other than module has claimed pin.
+func (a *ManagerAgent) checkPinUnclaimed(module string, pin string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for name, mod := range a.Modules {
+		user, ok := mod.(PinUser)
+		if name == module || !ok {
+			continue
+		}
+		for _, p := range user.Pins() {
+			if p == pin {
+				return InputError{error: fmt.Errorf("pin `%s` is already claimed by module `%s`", pin, name)}
+			}
+		}
+	}
+	return nil
+}
+
+// RestartModule stops the named module and replaces it with a fresh instance
+// built from the spec it was originally initialized with. If the rebuild
+// fails, the module is removed rather than left half-stopped.
+//
+// A wedged module may be slow to stop or fail to, so it is stopped and
+// rebuilt without a.mu held, and a failure to stop it is only logged. It's
+// marked as restarting meanwhile, so that new actions on it fail with a
+// RestartingError and anything else that would stop it waits for the
+// restart to finish.
+func (a *ManagerAgent) RestartModule(name string) error {
+	a.mu.Lock()
+	mod, ok := a.Modules[name]
+	spec := a.Specs[name]
+	if !ok {
+		a.mu.Unlock()
+		return NotFoundError{error: fmt.Errorf("no such module `%s`", name)}
+	}
+	if a.restarting[name] {
+		a.mu.Unlock()
+		return RestartingError{Module: name}
+	}
+	a.restarting[name] = true
+	a.mu.Unlock()
+
+	if err := mod.Stop(); err != nil {
+		a.Logger.Error("failed stopping module, restarting it anyway", "module", name, "error", err)
+	}
+	fresh, err := a.buildModule(name, spec)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.restarting, name)
+	a.restarted.Broadcast()
+
+	if a.Modules[name] != mod {
+		// it was replaced by InitializeEach, which doesn't stop what it
+		// replaces
+		if err == nil {
+			if stopErr := fresh.Stop(); stopErr != nil {
+				a.Logger.Error("failed stopping module", "module", name, "error", stopErr)
+			}
+		}
+		return fmt.Errorf("module `%s` changed while restarting", name)
+	}
+	if err != nil {
+		a.removeModule(name)
+		return fmt.Errorf("failed restarting module: %w", err)
+	}
+	a.Modules[name] = fresh
+	a.startWarmup(name, spec, fresh)
+
+	return nil
+}
+
+// awaitRestart waits for any restart of the named module to finish, so that
+// the instance being restarted isn't stopped twice. The caller must hold
+// a.mu, which is released while waiting.
+func (a *ManagerAgent) awaitRestart(name string) {
+	for a.restarting[name] {
+		a.restarted.Wait()
+	}
+}
+
+// ConfigSnapshotter is implemented by modules whose effective config drifts
+// from the one they were initialized with, e.g. after a calibration. The
+// returned value replaces the spec's config in snapshots.
+type ConfigSnapshotter interface {
+	SnapshotConfig() interface{}
+}
+
+// ConfigChanger is implemented by ConfigSnapshotters to say which of their
+// actions change their snapshot, so that the change can be saved.
+type ConfigChanger interface {
+	ChangesConfig(action string) bool
+}
+
+type Snapshot struct {
+	Modules map[string]ModuleSpec `json:"modules"`
+}
+
+// Binder binds a module config or action body according to the manager's
+// binding settings.
+func (a *ManagerAgent) Binder(body []byte) *JSONBinder {
+	return &JSONBinder{requestBody: bytes.NewBuffer(body), Strict: a.StrictBinding}
+}
+
+// NumModules counts the live modules.
+func (a *ManagerAgent) NumModules() int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return len(a.Modules)
+}
+
+// RequiresSubsystem reports whether any live module requires subsystem.
+func (a *ManagerAgent) RequiresSubsystem(subsystem string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, mod := range a.Modules {
+		user, ok := mod.(SubsystemUser)
+		if !ok {
+			continue
+		}
+		for _, required := range user.Requires() {
+			if required == subsystem {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Snapshot captures the spec of every live module, with configs updated to
+// reflect any runtime changes such as calibrations.
+func (a *ManagerAgent) Snapshot() (Snapshot, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.snapshot()
+}
+
+// snapshot must be called with a.mu held.
+func (a *ManagerAgent) snapshot() (Snapshot, error) {
+	snapshot := Snapshot{Modules: map[string]ModuleSpec{}}
+	for name, mod := range a.Modules {
+		spec := a.Specs[name]
+		if s, ok := mod.(ConfigSnapshotter); ok {
+			config, err := json.Marshal(s.SnapshotConfig())
+			if err != nil {
+				return Snapshot{}, fmt.Errorf("failed snapshotting module `%s`: %w", name, err)
+			}
+			spec.Config = config
+		}
+		snapshot.Modules[name] = spec
+	}
+	return snapshot, nil
+}
+
+// Restore tears down every live module and rebuilds the hub from snapshot.
+// If any module fails to initialize, the previous modules are rebuilt from
+// a snapshot taken just before the teardown.
+func (a *ManagerAgent) Restore(snapshot Snapshot) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, err := a.validateSpecs(snapshot.Modules, nil); err != nil {
+		return InputError{error: fmt.Errorf("invalid snapshot: %w", err)}
+	}
+
+	previous, err := a.snapshot()
+	if err != nil {
+		return err
+	}
+
+	a.stopAll()
+	if err := a.initializeModules(snapshot.Modules); err != nil {
+		a.stopAll()
+		if rbErr := a.initializeModules(previous.Modules); rbErr != nil {
+			a.Logger.Error("failed rolling back to previous modules", "error", rbErr)
+		}
+		return fmt.Errorf("failed restoring snapshot: %w", err)
+	}
+
+	a.logModuleSummary()
+	return nil
+}
+
+// StopModules stops and removes the named modules, or every module if names
+// is empty. All named modules must exist. A module is removed even if its
+// Stop fails, and every failure is reported together. A module that is
+// restarting is stopped once its restart finishes.
+func (a *ManagerAgent) StopModules(names []string) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(names) == 0 {
+		for name := range a.Modules {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if _, ok := a.Modules[name]; !ok {
+			return 0, NotFoundError{error: fmt.Errorf("no such module `%s`", name)}
+		}
+	}
+
+	var failures []string
+	for _, name := range names {
+		a.awaitRestart(name)
+		mod, ok := a.Modules[name]
+		if !ok {
+			// a failed restart removed it
+			continue
+		}
+		if err := mod.Stop(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+		a.removeModule(name)
+	}
+
+	if len(failures) > 0 {
+		return len(names), fmt.Errorf("failed stopping modules: %s", strings.Join(failures, "; "))
+	}
+	return len(names), nil
+}
+
+// Shutdown stops every module, then releases the ServiceProvider's
+// hardware handles.
+func (a *ManagerAgent) Shutdown() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.stopAll()
+	return a.ServiceProvider.Close()
+}
+
+// stopAll stops and removes every live module. The caller must hold a.mu.
+func (a *ManagerAgent) stopAll() {
+	for name := range a.Modules {
+		a.stopModule(name)
+	}
+}
+
+// stopModule stops and removes the named module, logging a failure to stop
+// it. The caller must hold a.mu, which is released while waiting out a
+// restart of the module.
+func (a *ManagerAgent) stopModule(name string) {
+	a.awaitRestart(name)
+	mod, ok := a.Modules[name]
+	if !ok {
+		// a failed restart removed it
+		return
+	}
+	if err := mod.Stop(); err != nil {
+		a.Logger.Error("failed stopping module", "module", name, "error", err)
+	}
+	a.removeModule(name)
+}
+
+// removeModule forgets everything about the named module. The caller must
+// hold a.mu and have already stopped it.
+func (a *ManagerAgent) removeModule(name string) {
+	delete(a.Modules, name)
+	delete(a.Specs, name)
+	delete(a.anomalies, name)
+	delete(a.readyAt, name)
+}
+
+// startWarmup records when a freshly built module will be ready. Modules
+// without a warmup period are ready immediately.
+func (a *ManagerAgent) startWarmup(name string, spec ModuleSpec, mod Module) {
+	var warmup time.Duration
+	if w, ok := mod.(Warmer); ok {
+		warmup = w.Warmup()
+	}
+	if spec.WarmupSeconds > 0 {
+		warmup = time.Duration(spec.WarmupSeconds * float64(time.Second))
+	}
+
+	if warmup > 0 {
+		a.readyAt[name] = time.Now().Add(warmup)
+	} else {
+		delete(a.readyAt, name)
+	}
+}
+
+type ModuleListing struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// ListModules reports every live module and its source, sorted by name.
+func (a *ManagerAgent) ListModules() []ModuleListing {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	listing := make([]ModuleListing, 0, len(a.Modules))
+	for name := range a.Modules {
+		listing = append(listing, ModuleListing{Name: name, Source: a.Specs[name].Source})
+	}
+	sort.Slice(listing, func(i, j int) bool { return listing[i].Name < listing[j].Name })
+	return listing
+}
+
+type ModuleHealth struct {
+	Name      string     `json:"name"`
+	Source    string     `json:"source"`
+	WarmingUp bool       `json:"warming_up"`
+	ReadyAt   *Timestamp `json:"ready_at,omitempty"`
+}
+
+// Health reports the warmup state of every live module, sorted by name.
+func (a *ManagerAgent) Health() []ModuleHealth {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	health := make([]ModuleHealth, 0, len(a.Modules))
+	for name := range a.Modules {
+		h := ModuleHealth{Name: name, Source: a.Specs[name].Source}
+		if readyAt, ok := a.readyAt[name]; ok {
+			ts := Timestamp(readyAt)
+			h.ReadyAt = &ts
+			h.WarmingUp = time.Now().Before(readyAt)
+		}
+		health = append(health, h)
+	}
+	sort.Slice(health, func(i, j int) bool { return health[i].Name < health[j].Name })
+	return health
+}
+
+////////////////
+// HTTP Logic //
+type InitializeRequest struct {
+	Modules map[string]ModuleSpec `json:"modules"`
+
+	// Replace stops every live module that isn't in Modules.
+	Replace bool `json:"replace"`
+}
+type ModuleSpec struct {
+	Source  string          `json:"source"`
+	Config  json.RawMessage `json:"config"`
+	Anomaly *AnomalyConfig  `json:"anomaly,omitempty"`
+
+	// DependsOn names modules that must be initialized before this one.
+	DependsOn []string `json:"depends_on,omitempty"`
+
+	// WarmupSeconds rejects actions for this long after initialization.
+	WarmupSeconds float64 `json:"warmup_seconds,omitempty"`
+
+	// DefaultAction is performed when an ActRequest has no action.
+	DefaultAction string `json:"default_action,omitempty"`
+}
+type InitializeResponse struct {
+	NumModules int `json:"num_modules"`
+}
+
+type ActRequest struct {
+	Module string          `json:"module"`
+	Action string          `json:"action"`
+	Config json.RawMessage `json:"config"`
+}
+type ActResponse struct {
+	Result interface{} `json:"result"`
+}
+type ScheduleResponse struct {
+	ID string `json:"id"`
+}
+
+type BatchActRequest struct {
+	Actions []ActRequest `json:"actions"`
+
+	// StopOnError ends the batch at the first failed action. The actions
+	// after it are not performed and get no result.
+	StopOnError bool `json:"stop_on_error"`
+}
+type BatchActResponse struct {
+	Results []BatchActResult `json:"results"`
+}
+
+// BatchActResult holds either the result of one action or its error.
+type BatchActResult struct {
+	Result interface{}    `json:"result,omitempty"`
+	Error  *BatchActError `json:"error,omitempty"`
+}
+
+// BatchActError carries the status code /act would have responded with.
+type BatchActError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type HealthzResponse struct {
+	I2CBus   bool   `json:"i2c_bus"`
+	I2CError string `json:"i2c_error,omitempty"`
+	Modules  int    `json:"modules"`
+}
+
+type StopRequest struct {
+	Modules []string `json:"modules"`
+}
+type StopResponse struct {
+	NumStopped int `json:"num_stopped"`
+}
+
+type RestartResponse struct {
+	Restarted bool `json:"restarted"`
+}
+type RebindPinResponse struct {
+	Rebound bool `json:"rebound"`
+}
+
+// MaxBenchmarkIterations bounds how long a single __benchmark can tie up a
+// module.
+const MaxBenchmarkIterations = 1000
+
+// BenchmarkRequest benchmarks Action, or the module's default action if it's
+// empty.
+type BenchmarkRequest struct {
+	Action     string          `json:"action"`
+	Config     json.RawMessage `json:"config"`
+	Iterations int             `json:"iterations"`
+}
+
+func (r *BenchmarkRequest) Default() {
+	r.Iterations = 10
+}
+func (r BenchmarkRequest) Validate() error {
+	if strings.HasPrefix(r.Action, "__") {
+		return fmt.Errorf("cannot benchmark pseudo-action `%s`", r.Action)
+	}
+	if r.Iterations < 1 || r.Iterations > MaxBenchmarkIterations {
+		return fmt.Errorf("iterations must be between 1 and %d", MaxBenchmarkIterations)
+	}
+	return nil
+}
+
+type BenchmarkResponse struct {
+	Iterations int     `json:"iterations"`
+	MinMS      float64 `json:"min_ms"`
+	MaxMS      float64 `json:"max_ms"`
+	MeanMS     float64 `json:"mean_ms"`
+	P95MS      float64 `json:"p95_ms"`
+}
+
+type ManagerAgent struct {
+	Modules         map[string]Module
+	Specs           map[string]ModuleSpec
+	ServiceProvider ServiceProvider
+	MaxModules      int
+	Logger          *slog.Logger
+
+	// StrictBinding makes Binder reject unknown fields.
+	StrictBinding bool
+
+	// OnConfigChange, if set, is called after an action that changed its
+	// module's config, without a.mu held.
+	OnConfigChange func()
+
+	mu        sync.RWMutex
+	rebindMu  sync.Mutex
+	anomalies map[string]*anomalyDetector
+	readyAt   map[string]time.Time
+
+	// restarting marks the modules being restarted. restarted is signalled,
+	// with a.mu as its lock, whenever a restart finishes.
+	restarting map[string]bool
+	restarted  *sync.Cond
+}
+
+// DefaultListenAddress is used when PIHUB_LISTEN_ADDR is not set. The listen
+// address is either a TCP host:port or a unix socket in the form
+// unix:/path/to.sock.
+const DefaultListenAddress = "0.0.0.0:3141"
+
+func NewManagerAgent(sp ServiceProvider, logger *slog.Logger) *ManagerAgent {
+	a := &ManagerAgent{
+		Modules:         map[string]Module{},
+		Specs:           map[string]ModuleSpec{},
+		ServiceProvider: sp,
+		MaxModules:      DefaultMaxModules,
+		Logger:          logger,
+		anomalies:       map[string]*anomalyDetector{},
+		readyAt:         map[string]time.Time{},
+		restarting:      map[string]bool{},
+	}
+	a.restarted = sync.NewCond(&a.mu)
+	return a
+}
+
+// DefaultActTimeout bounds how long an /act request waits for its action,
+// unless overridden with PIHUB_ACT_TIMEOUT or per request with the
+// X-Pihub-Timeout header. It's longer than the limits modules put on their
+// own blocking actions, like read_until and wait_edge.
+const DefaultActTimeout = 90 * time.Second
+
+// ActTimeoutHeader holds a per-request deadline for /act, as a Go duration
+// like "500ms" or "5s".
+const ActTimeoutHeader = "X-Pihub-Timeout"
+
+// actWithTimeout runs act, giving up after timeout. Module actions can't be
+// interrupted, so an action that times out keeps running in the background
+// and holds the module until it returns.
+func actWithTimeout(module, action string, timeout time.Duration, act func() (interface{}, error)) (interface{}, error) {
+	type outcome struct {
+		result interface{}
+		err    error
+	}
+
+	// buffered so that an abandoned action can still finish and exit
+	done := make(chan outcome, 1)
+	go func() {
+		result, err := act()
+		done <- outcome{result: result, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+		return nil, TimeoutError{Module: module, Action: action, Timeout: timeout}
+	}
+}
+
+// ActionRunner performs module actions for every entry point, so that /act,
+// /stream and the scheduler all record the same metrics and give up after
+// the same timeout.
+type ActionRunner struct {
+	Manager *ManagerAgent
+	Metrics *ActionMetrics
+
+	// Timeout applies to any action run without a deadline of its own.
+	Timeout time.Duration
+}
+
+func NewActionRunner(mgr *ManagerAgent, metrics *ActionMetrics, timeout time.Duration) *ActionRunner {
+	return &ActionRunner{Manager: mgr, Metrics: metrics, Timeout: timeout}
+}
+
+// Run performs one requested action, recording metrics and giving up after
+// timeout. Failures the client can fix are only warnings.
+func (r *ActionRunner) Run(ctx context.Context, req ActRequest, timeout time.Duration) (interface{}, error) {
+	mgr := r.Manager
+	module, action := mgr.MetricLabels(req.Module, req.Action)
+	result, err := r.Metrics.Observe(module, action, func() (interface{}, error) {
+		return actWithTimeout(req.Module, req.Action, timeout, func() (interface{}, error) {
+			return mgr.Act(req.Module, req.Action, mgr.Binder(req.Config))
+		})
+	})
+	if err != nil {
+		level := slog.LevelError
+		if actErrorStatus(err) < http.StatusInternalServerError {
+			level = slog.LevelWarn
+		}
+		mgr.Logger.Log(ctx, level, "action failed", "module", req.Module, "action", req.Action, "error", err)
+	}
+	return result, err
+}
+
+// requestTimeout reads the ActTimeoutHeader from r, falling back to def.
+func requestTimeout(r *http.Request, def time.Duration) (time.Duration, error) {
+	header := r.Header.Get(ActTimeoutHeader)
+	if header == "" {
+		return def, nil
+	}
+
+	timeout, err := time.ParseDuration(header)
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid %s header `%s`", ActTimeoutHeader, header)
+	}
+	return timeout, nil
+}
+
+// actErrorStatus is the HTTP status /act responds with for err.
+func actErrorStatus(err error) int {
+	var (
+		tErr    TimeoutError
+		warmErr WarmupError
+		rsErr   RestartingError
+		rlErr   RateLimitError
+		iErr    InputError
+		nfErr   NotFoundError
+	)
+	switch {
+	case errors.As(err, &tErr):
+		return http.StatusGatewayTimeout
+	case errors.As(err, &warmErr), errors.As(err, &rsErr):
+		return http.StatusServiceUnavailable
+	case errors.As(err, &rlErr):
+		return http.StatusTooManyRequests
+	case errors.As(err, &iErr):
+		return http.StatusBadRequest
+	case errors.As(err, &nfErr):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// DefaultShutdownTimeout bounds how long in-flight requests get to finish
+// on SIGINT/SIGTERM, unless overridden with PIHUB_SHUTDOWN_TIMEOUT.
+const DefaultShutdownTimeout = 10 * time.Second
+
+func main() {
+	level := DefaultLogLevel
+	if l := os.Getenv("PIHUB_LOG_LEVEL"); l != "" {
+		var err error
+		if level, err = ParseLogLevel(l); err != nil {
+			log.Fatal("invalid PIHUB_LOG_LEVEL: ", err.Error())
+		}
+	}
+	logger := NewLogger(level)
+	slog.SetDefault(logger)
+
+	sp, err := NewServiceProvider(logger)
+	if err != nil {
+		log.Fatal("failed initializing service provider")
+	}
+
+	mgr := NewManagerAgent(sp, logger)
+	if max := os.Getenv("PIHUB_MAX_MODULES"); max != "" {
+		if mgr.MaxModules, err = strconv.Atoi(max); err != nil {
+			log.Fatal("invalid PIHUB_MAX_MODULES: ", err.Error())
+		}
+	}
+
+	shutdownTimeout := DefaultShutdownTimeout
+	if timeout := os.Getenv("PIHUB_SHUTDOWN_TIMEOUT"); timeout != "" {
+		if shutdownTimeout, err = time.ParseDuration(timeout); err != nil {
+			log.Fatal("invalid PIHUB_SHUTDOWN_TIMEOUT: ", err.Error())
+		}
+	}
+
+	if strict := os.Getenv("PIHUB_STRICT_BINDING"); strict != "" {
+		if mgr.StrictBinding, err = strconv.ParseBool(strict); err != nil {
+			log.Fatal("invalid PIHUB_STRICT_BINDING: ", err.Error())
+		}
+	}
+
+	actTimeout := DefaultActTimeout
+	if timeout := os.Getenv("PIHUB_ACT_TIMEOUT"); timeout != "" {
+		if actTimeout, err = time.ParseDuration(timeout); err != nil {
+			log.Fatal("invalid PIHUB_ACT_TIMEOUT: ", err.Error())
+		}
+	}
+
+	state := &StateFile{Path: os.Getenv("PIHUB_STATE_FILE")}
+	saved, err := state.Load()
+	if err != nil {
+		logger.Error("failed loading saved modules", "error", err)
+	}
+	for name, err := range mgr.InitializeEach(saved.Modules) {
+		logger.Error("failed reinitializing saved module", "module", name, "error", err)
+	}
+
+	mgr.OnConfigChange = func() { saveModules(mgr, state) }
+
+	runner := NewActionRunner(mgr, NewActionMetrics(), actTimeout)
+	scheduler := NewScheduler(runner)
+	router := buildMux(runner, sp, scheduler, state)
+
+	addr := os.Getenv("PIHUB_LISTEN_ADDR")
+	if addr == "" {
+		addr = DefaultListenAddress
+	}
+
+	if format := os.Getenv("PIHUB_TIME_FORMAT"); format != "" {
+		encoding, err := ParseTimestampEncoding(format)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		TimestampFormat = encoding
+	}
+
+	listener, err := listen(addr)
+	if err != nil {
+		log.Fatal("failed listening on ", addr, ": ", err.Error())
+	}
+
+	redacted := map[string]bool{}
+	for _, path := range DefaultRedactedBodyPaths {
+		redacted[path] = true
+	}
+	for _, path := range strings.Split(os.Getenv("PIHUB_DUMP_REDACT_PATHS"), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			redacted[path] = true
+		}
+	}
+
+	server := &http.Server{Handler: requestIDs(dumpRequests(router, redacted, SensitiveFields(), logger))}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	go func() {
+		// closes the listener, which also removes a unix socket file
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Fatal("failed serving: ", err.Error())
+		}
+	}()
+
+	<-ctx.Done()
+	logger.Info("shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("failed shutting down HTTP server cleanly", "error", err)
+	}
+
+	scheduler.StopAll(shutdownCtx)
+	if err := mgr.Shutdown(); err != nil {
+		logger.Error("failed releasing hardware", "error", err)
+	}
+}
+
+// requestIDs gives every request an id, which is returned in the
+// X-Request-ID response header and added to anything logged with the
+// request's context. A well-formed id supplied by the client is kept.
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// DefaultRedactedBodyPaths are never dumped with their bodies, since module
+// configs may contain secrets. PIHUB_DUMP_REDACT_PATHS adds to this list.
+var DefaultRedactedBodyPaths = []string{"/initialize", "/snapshot/restore"}
+
+// dumpRequests logs every request at the debug level before passing it on.
+// The Authorization header is always redacted, requests to any of the
+// redacted paths are dumped without their body, and the sensitive fields of
+// any other JSON body are redacted wherever they appear in it.
+func dumpRequests(next http.Handler, redactedBodyPaths map[string]bool, sensitiveFields map[string]bool, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !logger.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		dump := r.Clone(r.Context())
+		if dump.Header.Get("Authorization") != "" {
+			dump.Header.Set("Authorization", "[REDACTED]")
+		}
+
+		withBody := !redactedBodyPaths[r.URL.Path]
+		if withBody && r.Body != nil && r.Body != http.NoBody {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				logger.ErrorContext(r.Context(), "failed reading request body -- aborting", "error", err)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			redacted := redactFields(body, sensitiveFields)
+			dump.Body = io.NopCloser(bytes.NewReader(redacted))
+			dump.ContentLength = int64(len(redacted))
+		}
+		bs, err := httputil.DumpRequest(dump, withBody)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "failed dumping request -- aborting", "error", err)
+			return
+		}
+
+		logger.DebugContext(r.Context(), "request", "dump", string(bs), "body_redacted", !withBody)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactFields replaces the value of every key in fields, at any depth of a
+// JSON body, with "[REDACTED]". A body that isn't JSON can't have fields, so
+// it's returned as is.
+func redactFields(body []byte, fields map[string]bool) []byte {
+	if len(fields) == 0 {
+		return body
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return body
+	}
+
+	var redact func(v interface{})
+	redact = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for key, val := range v {
+				if fields[key] {
+					v[key] = "[REDACTED]"
+					continue
+				}
+				redact(val)
+			}
+		case []interface{}:
+			for _, val := range v {
+				redact(val)
 			}
-		} else {
-			return fmt.Errorf("404 no such module source: %s", spec.Source)
 		}
 	}
-	return nil
-}
-func (a *ManagerAgent) Act(module string, action string, binder Binder) (interface{}, error) {
-	if mod, ok := a.Modules[module]; ok {
-		return mod.Act(action, binder)
-	}
-	return nil, errors.New("no such module") // TODO 404
-}
+	redact(v)
 
-////////////////
-// HTTP Logic //
-type InitializeRequest struct {
-	Modules map[string]ModuleSpec `json:"modules"`
-}
-type ModuleSpec struct {
-	Source string          `json:"source"`
-	Config json.RawMessage `json:"config"`
-}
-type InitializeResponse struct {
-	NumModules int `json:"num_modules"`
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return redacted
 }
 
-type ActRequest struct {
-	Module string          `json:"module"`
-	Action string          `json:"action"`
-	Config json.RawMessage `json:"config"`
-}
-type ActResponse struct {
-	Result interface{} `json:"result"`
-}
+// listen opens a TCP listener, or a unix socket listener if the address has
+// a "unix:" prefix. A stale socket file left behind by a previous run is
+// removed first, and closing the listener removes the socket file.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
 
-type ManagerAgent struct {
-	Modules         map[string]Module
-	ServiceProvider ServiceProvider
-}
+	path := strings.TrimPrefix(addr, "unix:")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed removing stale socket: %w", err)
+	}
 
-func main() {
-	router := buildMux()
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
 
-	_ = http.ListenAndServe("0.0.0.0:3141", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if bs, err := httputil.DumpRequest(r, true); err != nil {
-			fmt.Println("failed dumping request -- aborting", err.Error())
-			return
-		} else {
-			fmt.Println("---DUMPING REQUEST ---")
-			fmt.Println(string(bs))
-		}
+	// only the owning user and group may connect
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed setting socket permissions: %w", err)
+	}
 
-		router.ServeHTTP(w, r)
-	}))
+	return listener, nil
 }
 
-func buildMux() *http.ServeMux {
-	sp, err := NewServiceProvider()
+// writeJSON responds with status and v encoded as JSON. v is encoded before
+// anything is sent, so that a failure can still be reported as a 500.
+func writeJSON(w http.ResponseWriter, r *http.Request, logger *slog.Logger, status int, v interface{}) {
+	body, err := json.Marshal(v)
 	if err != nil {
-		log.Fatal("failed initializing service provider")
+		logger.ErrorContext(r.Context(), "failed encoding HTTP response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
-	mgr := &ManagerAgent{
-		Modules:         map[string]Module{},
-		ServiceProvider: sp,
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		logger.ErrorContext(r.Context(), "failed writing HTTP response", "error", err)
+	}
+}
+
+// saveModules saves the current modules after any change to them. A failure
+// only costs us the modules on the next restart, so it's logged rather than
+// failing whatever made the change.
+func saveModules(mgr *ManagerAgent, state *StateFile) {
+	snapshot, err := mgr.Snapshot()
+	if err == nil {
+		err = state.Save(snapshot)
+	}
+	if err != nil {
+		mgr.Logger.Error("failed saving modules", "error", err)
 	}
+}
+
+func buildMux(runner *ActionRunner, sp *ServiceAgent, scheduler *Scheduler, state *StateFile) *http.ServeMux {
+	mgr := runner.Manager
+	logger := mgr.Logger
+
+	persist := func() { saveModules(mgr, state) }
 
 	mux := http.NewServeMux()
 	mux.Handle("/initialize", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -121,21 +1668,30 @@ func buildMux() *http.ServeMux {
 
 		var req InitializeRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			fmt.Println("failed decoding body", err.Error())
+			logger.WarnContext(r.Context(), "failed decoding body", "error", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		if err := mgr.InitializeModules(req.Modules); err != nil {
-			fmt.Println("failed initializing modules", err.Error())
+		// modules ahead of one that fails may already have been added,
+		// replaced or stopped, so the result is saved either way
+		err := mgr.InitializeModules(req.Modules, req.Replace)
+		persist()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "failed initializing modules", "error", err)
+
+			// e.g. a config that fails validation or, with strict binding, has
+			// unknown fields
+			var iErr InputError
+			if errors.As(err, &iErr) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 
-		if err := json.NewEncoder(w).Encode(InitializeResponse{NumModules: len(mgr.Modules)}); err != nil {
-			fmt.Println("failed sending response", err.Error())
-			return
-		}
+		writeJSON(w, r, logger, http.StatusOK, InitializeResponse{NumModules: mgr.NumModules()})
 	}))
 	mux.Handle("/act", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
@@ -145,42 +1701,252 @@ func buildMux() *http.ServeMux {
 
 		var req ActRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			fmt.Println("failed decoding body", err.Error())
+			logger.WarnContext(r.Context(), "failed decoding body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		timeout, err := requestTimeout(r, runner.Timeout)
+		if err != nil {
+			logger.WarnContext(r.Context(), "invalid request timeout", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		result, err := runner.Run(r.Context(), req, timeout)
+		if err != nil {
+			// the same mapping as /act/batch, so the two can't drift apart
+			status := actErrorStatus(err)
+			message := err.Error()
+			if status == http.StatusBadRequest || status == http.StatusInternalServerError {
+				message = fmt.Sprintf("invalid request: %s", message)
+			}
+			writeJSON(w, r, logger, status, map[string]interface{}{
+				"mesage": message,
+			})
+			return
+		}
+		writeJSON(w, r, logger, http.StatusOK, ActResponse{Result: result})
+	}))
+
+	mux.Handle("/act/batch", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req BatchActRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			logger.WarnContext(r.Context(), "failed decoding body", "error", err)
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
-		actRequest := &JSONBinder{requestBody: bytes.NewBuffer([]byte(req.Config))}
-		if result, err := mgr.Act(req.Module, req.Action, actRequest); err != nil {
+		timeout, err := requestTimeout(r, runner.Timeout)
+		if err != nil {
+			logger.WarnContext(r.Context(), "invalid request timeout", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
-			// errors that passed through the JSONBinder will be marked so we can
-			// respond with a 400 instead.
-			var iErr InputError
-			if errors.As(err, &iErr) {
-				w.WriteHeader(http.StatusBadRequest)
-				if wErr := json.NewEncoder(w).Encode(map[string]interface{}{
-					"mesage": fmt.Sprintf("invalid request: %s", err.Error()),
-				}); wErr != nil {
-					fmt.Println("failed writing HTTP response:", wErr.Error())
-					return
+		// a well-formed batch always gets a 200, with each action's outcome
+		// reported in its own result
+		resp := BatchActResponse{Results: []BatchActResult{}}
+		for _, item := range req.Actions {
+			result, err := runner.Run(r.Context(), item, timeout)
+			if err != nil {
+				resp.Results = append(resp.Results, BatchActResult{Error: &BatchActError{
+					Code:    actErrorStatus(err),
+					Message: err.Error(),
+				}})
+				if req.StopOnError {
+					break
 				}
+				continue
 			}
+			resp.Results = append(resp.Results, BatchActResult{Result: result})
+		}
 
-			// otherwise, we respond with a 500
-			w.WriteHeader(http.StatusInternalServerError)
-			if wErr := json.NewEncoder(w).Encode(map[string]interface{}{
-				"mesage": fmt.Sprintf("invalid request: %s", err.Error()),
-			}); wErr != nil {
-				fmt.Println("failed executing action:", wErr.Error())
+		writeJSON(w, r, logger, http.StatusOK, resp)
+	}))
+
+	mux.Handle("/stream", streamHandler(runner))
+	mux.Handle("/metrics", runner.Metrics.Handler())
+
+	mux.Handle("/stop", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req StopRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			logger.WarnContext(r.Context(), "failed decoding body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// modules are removed even if they fail to stop, so the count is
+		// reported either way
+		status := http.StatusOK
+		stopped, err := mgr.StopModules(req.Modules)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "failed stopping modules", "error", err)
+
+			status = http.StatusInternalServerError
+			var nfErr NotFoundError
+			if errors.As(err, &nfErr) {
+				status = http.StatusNotFound
+			}
+		}
+		if stopped > 0 {
+			persist()
+		}
+
+		writeJSON(w, r, logger, status, StopResponse{NumStopped: stopped})
+	}))
+	mux.Handle("/schedule", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, r, logger, http.StatusOK, scheduler.List())
+		case "POST":
+			var spec ScheduleSpec
+			if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+				logger.WarnContext(r.Context(), "failed decoding body", "error", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			id, err := scheduler.Add(spec)
+			if err != nil {
+				logger.ErrorContext(r.Context(), "failed adding schedule", "error", err)
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+
+			writeJSON(w, r, logger, http.StatusOK, ScheduleResponse{ID: id})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	mux.Handle("/schedule/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := scheduler.Remove(strings.TrimPrefix(r.URL.Path, "/schedule/")); err != nil {
+			logger.ErrorContext(r.Context(), "failed removing schedule", "error", err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.Handle("/snapshot", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		snapshot, err := mgr.Snapshot()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "failed taking snapshot", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, snapshot)
+	}))
+	mux.Handle("/snapshot/restore", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		var snapshot Snapshot
+		if err := json.NewDecoder(r.Body).Decode(&snapshot); err != nil {
+			logger.WarnContext(r.Context(), "failed decoding body", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
 			return
-		} else {
-			if err := json.NewEncoder(w).Encode(ActResponse{Result: result}); err != nil {
-				fmt.Println("failed writing HTTP response:", err.Error())
+		}
+
+		if err := mgr.Restore(snapshot); err != nil {
+			logger.ErrorContext(r.Context(), "failed restoring snapshot", "error", err)
+
+			var iErr InputError
+			if errors.As(err, &iErr) {
+				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		persist()
+
+		writeJSON(w, r, logger, http.StatusOK, InitializeResponse{NumModules: len(snapshot.Modules)})
+	}))
+
+	mux.Handle("/modules", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, mgr.ListModules())
+	}))
+	mux.Handle("/healthz", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		// a broken bus only makes the hub unhealthy if something needs it
+		healthy, i2cErr := sp.I2CHealthy()
+		resp := HealthzResponse{I2CBus: healthy, Modules: mgr.NumModules()}
+		if i2cErr != nil {
+			resp.I2CError = i2cErr.Error()
 		}
+		status := http.StatusOK
+		if !healthy && mgr.RequiresSubsystem(SubsystemI2C) {
+			status = http.StatusServiceUnavailable
+		}
+
+		writeJSON(w, r, logger, status, resp)
+	}))
+
+	mux.Handle("/schema", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, DescribeSources())
+	}))
+
+	mux.Handle("/modules/health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, mgr.Health())
+	}))
+
+	mux.Handle("/diag/periph", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, sp.PeriphDiag())
+	}))
+	mux.Handle("/gpio/list", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeJSON(w, r, logger, http.StatusOK, sp.GPIOPins())
 	}))
 
 	return mux
@@ -195,38 +1961,179 @@ type ServiceProvider interface {
 	GetGPIOByName(name string) (gpio.PinIO, error)
 	GetDefaultI2CBus() (i2c.BusCloser, error)
 
+	// SPI ports belong to whoever asked for them and must be closed by them.
+	GetDefaultSPIPort() (spi.PortCloser, error)
+	GetSPIPortByName(name string) (spi.PortCloser, error)
+
+	// Subsystems lists the hardware subsystems that initialized successfully.
+	Subsystems() []string
+
 	Close() error
 }
 
-func NewServiceProvider() (*ServiceAgent, error) {
-	_, err := host.Init()
+func NewServiceProvider(logger *slog.Logger) (*ServiceAgent, error) {
+	state, err := host.Init()
 	if err != nil {
-		fmt.Println("failed initializing perph.io host", err.Error())
+		logger.Error("failed initializing perph.io host", "error", err)
 		return nil, err
 	}
 
-	bus, err := i2creg.Open("")
-	if err != nil {
-		fmt.Println("failed to identify an i2c bus - modules relying on I2C will fail to initialize: ", err.Error())
+	agent := &ServiceAgent{
+		periphState: state,
 	}
 
-	return &ServiceAgent{
-		defaultI2CBus: bus,
-	}, nil
+	openBus := func() (i2c.BusCloser, error) { return i2creg.Open("") }
+	if bus, err := openBus(); err != nil {
+		agent.i2cErr = err
+		logger.Warn("failed to identify an i2c bus - modules relying on I2C will fail to initialize", "error", err)
+	} else {
+		agent.defaultI2CBus = newReconnectingBus(bus, openBus, logger)
+	}
+
+	return agent, nil
 }
 
 type ServiceAgent struct {
 	defaultI2CBus i2c.BusCloser
+	periphState   *periph.State
+
+	// i2cErr is why the default I2C bus failed to open, if it did.
+	i2cErr error
+
+	spiPorts spiPorts
+}
+
+// I2CHealthy reports whether the default I2C bus opened and isn't stuck
+// failing to reconnect, along with why not.
+func (a *ServiceAgent) I2CHealthy() (bool, error) {
+	if a.defaultI2CBus == nil {
+		return false, a.i2cErr
+	}
+	if bus, ok := a.defaultI2CBus.(*reconnectingBus); ok {
+		return bus.Healthy()
+	}
+	return true, nil
+}
+
+type PeriphDiagResponse struct {
+	Loaded  []string              `json:"loaded"`
+	Skipped []PeriphDriverFailure `json:"skipped"`
+	Failed  []PeriphDriverFailure `json:"failed"`
+}
+type PeriphDriverFailure struct {
+	Driver string `json:"driver"`
+	Error  string `json:"error"`
+}
+
+// PeriphDiag reports which periph drivers loaded, were skipped or failed
+// when the host was initialized.
+func (a *ServiceAgent) PeriphDiag() PeriphDiagResponse {
+	resp := PeriphDiagResponse{
+		Loaded:  []string{},
+		Skipped: []PeriphDriverFailure{},
+		Failed:  []PeriphDriverFailure{},
+	}
+	if a.periphState == nil {
+		return resp
+	}
+
+	for _, d := range a.periphState.Loaded {
+		resp.Loaded = append(resp.Loaded, d.String())
+	}
+	for _, f := range a.periphState.Skipped {
+		resp.Skipped = append(resp.Skipped, newPeriphDriverFailure(f))
+	}
+	for _, f := range a.periphState.Failed {
+		resp.Failed = append(resp.Failed, newPeriphDriverFailure(f))
+	}
+	return resp
+}
+func newPeriphDriverFailure(f periph.DriverFailure) PeriphDriverFailure {
+	failure := PeriphDriverFailure{Driver: f.D.String()}
+	if f.Err != nil {
+		failure.Error = f.Err.Error()
+	}
+	return failure
 }
 
 func (a *ServiceAgent) GetDefaultI2CBus() (i2c.BusCloser, error) {
+	if a.defaultI2CBus == nil {
+		return nil, errors.New("no default i2c bus is available")
+	}
 	return a.defaultI2CBus, nil
 }
+func (a *ServiceAgent) GetDefaultSPIPort() (spi.PortCloser, error) {
+	return a.GetSPIPortByName("")
+}
+func (a *ServiceAgent) GetSPIPortByName(name string) (spi.PortCloser, error) {
+	if !spiAvailable() {
+		return nil, errNoSPIPort
+	}
+	return a.spiPorts.Open(name)
+}
+func (a *ServiceAgent) Subsystems() []string {
+	subsystems := []string{SubsystemGPIO}
+	if a.defaultI2CBus != nil {
+		subsystems = append(subsystems, SubsystemI2C)
+	}
+	if spiAvailable() {
+		subsystems = append(subsystems, SubsystemSPI)
+	}
+	return subsystems
+}
 func (a *ServiceAgent) GetGPIOByName(name string) (gpio.PinIO, error) {
 	return gpioreg.ByName(name), nil
 }
+
+type GPIOListResponse struct {
+	Pins    []GPIOPinInfo   `json:"pins"`
+	Aliases []GPIOAliasInfo `json:"aliases"`
+}
+type GPIOPinInfo struct {
+	Name     string `json:"name"`
+	Number   int    `json:"number"`
+	Function string `json:"function"`
+}
+type GPIOAliasInfo struct {
+	Name   string `json:"name"`
+	Target string `json:"target"`
+}
+
+// GPIOPins lists every GPIO pin registered with periph, along with the
+// aliases pointing at them (e.g. the bcm283x "PWM0_OUT" or "GPCLK0" names).
+// Any of these names is valid as a module's pin config.
+func (a *ServiceAgent) GPIOPins() GPIOListResponse {
+	resp := GPIOListResponse{
+		Pins:    []GPIOPinInfo{},
+		Aliases: []GPIOAliasInfo{},
+	}
+
+	for _, p := range gpioreg.All() {
+		resp.Pins = append(resp.Pins, GPIOPinInfo{
+			Name:     p.Name(),
+			Number:   p.Number(),
+			Function: p.Function(),
+		})
+	}
+	for _, p := range gpioreg.Aliases() {
+		alias := GPIOAliasInfo{Name: p.Name()}
+		if r, ok := p.(gpio.RealPin); ok {
+			alias.Target = r.Real().Name()
+		}
+		resp.Aliases = append(resp.Aliases, alias)
+	}
+	return resp
+}
+
 func (a *ServiceAgent) Close() error {
-	return a.defaultI2CBus.Close()
+	spiErr := a.spiPorts.CloseAll()
+	if a.defaultI2CBus == nil {
+		return spiErr
+	}
+	if err := a.defaultI2CBus.Close(); err != nil {
+		return err
+	}
+	return spiErr
 }
 
 //////////////////////
@@ -237,20 +2144,51 @@ type Binder interface {
 type Validator interface {
 	Validate() error
 }
+type Defaulter interface {
+	Default()
+}
 
 type JSONBinder struct {
 	requestBody io.Reader
+
+	// Strict rejects bodies with fields the target doesn't have, so that a
+	// misspelled key is an error rather than silently ignored. Targets that
+	// aren't structs, like the echo module's, are unaffected.
+	Strict bool
 }
 
 type InputError struct {
 	error
 }
 
+// NotFoundError marks errors caused by referring to something, like a
+// module, that doesn't exist, so the HTTP layer can respond with a 404.
+type NotFoundError struct {
+	error
+}
+
+// BindData applies any defaults to ptr and then decodes the request body over
+// them. An absent or null body leaves the defaults untouched.
 func (b *JSONBinder) BindData(ptr interface{}) error {
-	if err := json.NewDecoder(b.requestBody).Decode(ptr); err != nil {
+	if d, ok := ptr.(Defaulter); ok {
+		d.Default()
+	}
+
+	body, err := ioutil.ReadAll(b.requestBody)
+	if err != nil {
 		return InputError{error: err}
 	}
 
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && !bytes.Equal(trimmed, []byte("null")) {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		if b.Strict {
+			decoder.DisallowUnknownFields()
+		}
+		if err := decoder.Decode(ptr); err != nil {
+			return InputError{error: err}
+		}
+	}
+
 	if v, ok := ptr.(Validator); ok {
 		if err := v.Validate(); err != nil {
 			return InputError{error: err}
@@ -259,3 +2197,40 @@ func (b *JSONBinder) BindData(ptr interface{}) error {
 
 	return nil
 }
+
+////////////////
+// timestamps //
+type TimestampEncoding string
+
+const (
+	TimestampRFC3339     TimestampEncoding = "rfc3339"
+	TimestampEpochMillis TimestampEncoding = "epoch_millis"
+)
+
+// TimestampFormat selects how every Timestamp in a response is encoded. It
+// is set once at startup from PIHUB_TIME_FORMAT.
+var TimestampFormat = TimestampRFC3339
+
+func ParseTimestampEncoding(s string) (TimestampEncoding, error) {
+	switch encoding := TimestampEncoding(s); encoding {
+	case TimestampRFC3339, TimestampEpochMillis:
+		return encoding, nil
+	default:
+		return "", fmt.Errorf("unsupported time format `%s`, expected `%s` or `%s`",
+			s, TimestampRFC3339, TimestampEpochMillis)
+	}
+}
+
+// Timestamp is a time.Time that encodes itself according to TimestampFormat.
+// Use it for any time field in a response.
+type Timestamp time.Time
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	switch TimestampFormat {
+	case TimestampEpochMillis:
+		millis := time.Time(t).UnixNano() / int64(time.Millisecond)
+		return []byte(strconv.FormatInt(millis, 10)), nil
+	default:
+		return json.Marshal(time.Time(t).Format(time.RFC3339Nano))
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+)
+
+func TestSlowActionDoesNotBlockOtherModules(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(""), "b": fakeSpec("")})
+
+	go mgr.Act("a", "sleep", mgr.Binder([]byte(`{"ms": 500}`)))
+	time.Sleep(50 * time.Millisecond)
+
+	restarted := make(chan error, 1)
+	go func() { restarted <- mgr.RestartModule("a") }()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := mgr.Act("b", "read", mgr.Binder(nil)); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("read on b took %s while a was busy", elapsed)
+	}
+
+	if err := <-restarted; err != nil {
+		t.Errorf("restart failed: %v", err)
+	}
+}
+
+func TestRestartModuleReplacesModuleThatFailsToStop(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"stop_error": "wedged"}`)})
+	old := mgr.Modules["a"].(*fakeModule)
+
+	if err := mgr.RestartModule("a"); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	if !old.isStopped() {
+		t.Error("old module wasn't stopped")
+	}
+	if mgr.Modules["a"] == Module(old) {
+		t.Error("module wasn't replaced")
+	}
+}
+
+// TestRestartModuleConcurrentCalls is only meaningful under go test -race.
+func TestRestartModuleConcurrentCalls(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(""), "b": fakeSpec("")})
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			mgr.Act("a", "__restart", mgr.Binder(nil))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			var rsErr RestartingError
+			if _, err := mgr.Act("a", "read", mgr.Binder(nil)); err != nil && !errors.As(err, &rsErr) {
+				t.Errorf("read failed: %v", err)
+			}
+			if _, err := mgr.Act("b", "read", mgr.Binder(nil)); err != nil {
+				t.Errorf("read on b failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(time.Millisecond)
+		if _, err := mgr.StopModules([]string{"a"}); err != nil {
+			t.Errorf("stop failed: %v", err)
+		}
+	}()
+	wg.Wait()
+
+	if _, ok := mgr.Modules["a"]; ok {
+		t.Error("stopped module is still live")
+	}
+}
+
+func TestRestartModuleRemovesModuleThatFailsToRebuild(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	mgr.Specs["a"] = fakeSpec(`{"init_error": "gone"}`)
+
+	if err := mgr.RestartModule("a"); err == nil {
+		t.Fatal("expected restart to fail")
+	}
+	if _, ok := mgr.Modules["a"]; ok {
+		t.Error("module that failed to rebuild is still live")
+	}
+}
+
+func TestInitializeEachLeavesOutOnlyBadModules(t *testing.T) {
+	mgr := newTestManager()
+	dependsOn := func(spec ModuleSpec, deps ...string) ModuleSpec {
+		spec.DependsOn = deps
+		return spec
+	}
+
+	failed := mgr.InitializeEach(map[string]ModuleSpec{
+		"good":        fakeSpec(""),
+		"renamed":     {Source: "no_such_source"},
+		"bad_anomaly": {Source: "fake", Anomaly: &AnomalyConfig{Alpha: 2}},
+		"broken":      fakeSpec(`{"init_error": "no device"}`),
+		"orphan":      dependsOn(fakeSpec(""), "missing"),
+		"dependent":   dependsOn(fakeSpec(""), "renamed"),
+		"transitive":  dependsOn(fakeSpec(""), "dependent"),
+		"after_good":  dependsOn(fakeSpec(""), "good"),
+		"cycle_a":     dependsOn(fakeSpec(""), "cycle_b"),
+		"cycle_b":     dependsOn(fakeSpec(""), "cycle_a"),
+	})
+
+	for _, name := range []string{"good", "after_good"} {
+		if _, ok := mgr.Modules[name]; !ok {
+			t.Errorf("module `%s` wasn't initialized: %v", name, failed[name])
+		}
+	}
+	for _, name := range []string{"renamed", "bad_anomaly", "broken", "orphan", "dependent", "transitive", "cycle_a", "cycle_b"} {
+		if _, ok := failed[name]; !ok {
+			t.Errorf("module `%s` should have failed", name)
+		}
+		if _, ok := mgr.Modules[name]; ok {
+			t.Errorf("module `%s` shouldn't be live", name)
+		}
+	}
+	if len(failed) != 8 {
+		t.Errorf("got %d failures, want 8: %v", len(failed), failed)
+	}
+}
+
+func TestInitializeEachStopsAtModuleLimit(t *testing.T) {
+	mgr := newTestManager()
+	mgr.MaxModules = 2
+
+	failed := mgr.InitializeEach(map[string]ModuleSpec{"a": fakeSpec(""), "b": fakeSpec(""), "c": fakeSpec("")})
+	if len(mgr.Modules) != 2 || len(failed) != 1 {
+		t.Errorf("got %d modules and %d failures, want 2 and 1", len(mgr.Modules), len(failed))
+	}
+}
+
+func TestRebindPinOutlivesRestart(t *testing.T) {
+	testPin(t, "REBIND_OLD")
+	newPin := testPin(t, "REBIND_NEW")
+
+	mgr := newTestManager()
+	changes := 0
+	mgr.OnConfigChange = func() { changes++ }
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"relay": {Source: "relay", Config: json.RawMessage(`{"pin": "REBIND_OLD"}`)},
+	})
+
+	if _, err := mgr.Act("relay", RebindPinAction, mgr.Binder([]byte(`{"pin": "REBIND_NEW"}`))); err != nil {
+		t.Fatalf("rebind failed: %v", err)
+	}
+	if changes != 1 {
+		t.Errorf("got %d config changes, want 1", changes)
+	}
+
+	if err := mgr.RestartModule("relay"); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+	if _, err := mgr.Act("relay", "set", mgr.Binder([]byte(`{"high": true}`))); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if level(newPin) != gpio.High {
+		t.Error("relay isn't driving the rebound pin after a restart")
+	}
+
+	snapshot, err := mgr.Snapshot()
+	if err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	var config RelayModuleConfig
+	if err := json.Unmarshal(snapshot.Modules["relay"].Config, &config); err != nil {
+		t.Fatalf("failed decoding snapshot config: %v", err)
+	}
+	if config.Pin != "REBIND_NEW" {
+		t.Errorf("snapshot has pin `%s`, want REBIND_NEW", config.Pin)
+	}
+}
+
+func TestInitializeModulesReplacement(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    ModuleSpec
+		replace bool
+
+		wantErr      bool
+		wantSame     bool
+		wantOldValue float64
+	}{
+		{name: "identical spec is a no-op", spec: fakeSpec(`{"value": 1}`), wantSame: true, wantOldValue: 1},
+		{name: "changed spec replaces", spec: fakeSpec(`{"value": 2}`), wantOldValue: 2},
+		{name: "failed replacement keeps old", spec: fakeSpec(`{"init_error": "no device"}`), wantErr: true, wantOldValue: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := newTestManager()
+			mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 1}`), "b": fakeSpec("")})
+			old := mgr.Modules["a"].(*fakeModule)
+
+			err := mgr.InitializeModules(map[string]ModuleSpec{"a": tc.spec}, false)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+
+			if same := mgr.Modules["a"] == Module(old); same != tc.wantSame {
+				t.Errorf("module kept: %v, want %v", same, tc.wantSame)
+			}
+			if old.isStopped() == tc.wantSame {
+				t.Errorf("old module stopped: %v, want %v", old.isStopped(), !tc.wantSame)
+			}
+			result, err := mgr.Act("a", "read", mgr.Binder(nil))
+			if err != nil || result != tc.wantOldValue {
+				t.Errorf("read got %v, %v, want %v", result, err, tc.wantOldValue)
+			}
+			if _, ok := mgr.Modules["b"]; !ok {
+				t.Error("merging removed an unrelated module")
+			}
+		})
+	}
+}
+
+func TestInitializeModulesReplaceRemovesAbsent(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(""), "b": fakeSpec("")})
+	b := mgr.Modules["b"].(*fakeModule)
+
+	if err := mgr.InitializeModules(map[string]ModuleSpec{"a": fakeSpec("")}, true); err != nil {
+		t.Fatalf("replace failed: %v", err)
+	}
+	if _, ok := mgr.Modules["b"]; ok || !b.isStopped() {
+		t.Error("module missing from a replace wasn't stopped and removed")
+	}
+	if _, ok := mgr.Modules["a"]; !ok {
+		t.Error("module in the replace was removed")
+	}
+}
+
+func TestInitializeModulesInvalidReplaceStopsNothing(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+
+	if err := mgr.InitializeModules(map[string]ModuleSpec{"b": {Source: "no_such_source"}}, true); err == nil {
+		t.Fatal("expected an invalid spec to fail")
+	}
+	if _, ok := mgr.Modules["a"]; !ok {
+		t.Error("an invalid replace stopped a live module")
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		spec    ModuleSpec
+		request string
+		warming bool
+
+		wantErr error
+		wantMin float64
+	}{
+		{name: "named action", spec: fakeSpec(""), request: `{"action": "sleep", "config": {"ms": 5}, "iterations": 3}`, wantMin: 5},
+		{name: "default action", spec: ModuleSpec{Source: "fake", Config: json.RawMessage(`{}`), DefaultAction: "sleep"}, request: `{"config": {"ms": 5}, "iterations": 3}`, wantMin: 5},
+		{name: "no default action", spec: fakeSpec(""), request: `{}`, wantErr: InputError{}},
+		{name: "unknown action", spec: fakeSpec(""), request: `{"action": "nope"}`, wantErr: NotFoundError{}},
+		{name: "warming up", spec: fakeSpec(""), request: `{"action": "read"}`, warming: true, wantErr: WarmupError{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := newTestManager()
+			mustInitialize(t, mgr, map[string]ModuleSpec{"a": tc.spec})
+			if tc.warming {
+				mgr.readyAt["a"] = time.Now().Add(time.Hour)
+			}
+
+			result, err := mgr.Act("a", BenchmarkAction, mgr.Binder([]byte(tc.request)))
+			if tc.wantErr != nil {
+				if actErrorStatus(err) != actErrorStatus(tc.wantErr) {
+					t.Fatalf("got error %v, want a %T", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("benchmark failed: %v", err)
+			}
+
+			response := result.(BenchmarkResponse)
+			if response.Iterations != 3 {
+				t.Errorf("got %d iterations, want 3", response.Iterations)
+			}
+			if response.MinMS < tc.wantMin || response.MaxMS < response.P95MS || response.P95MS < response.MinMS {
+				t.Errorf("implausible timings: %+v", response)
+			}
+		})
+	}
+}
+
+func TestBenchmarkRequest(t *testing.T) {
+	for _, tc := range []struct {
+		body           string
+		wantErr        bool
+		wantIterations int
+	}{
+		{body: `{}`, wantIterations: 10},
+		{body: `{"action": "read", "iterations": 1000}`, wantIterations: MaxBenchmarkIterations},
+		{body: `{"action": "__restart"}`, wantErr: true},
+		{body: `{"iterations": 0}`, wantErr: true},
+		{body: `{"iterations": 1001}`, wantErr: true},
+	} {
+		var request BenchmarkRequest
+		err := bind(tc.body, &request)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+		if !tc.wantErr && request.Iterations != tc.wantIterations {
+			t.Errorf("%s: got %d iterations, want %d", tc.body, request.Iterations, tc.wantIterations)
+		}
+	}
+}
+
+func TestInitializeChecksRequiredSubsystems(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		sp      *ServiceAgent
+		wantErr bool
+	}{
+		{"available", &ServiceAgent{defaultI2CBus: &i2ctest.Playback{}}, false},
+		{"missing", &ServiceAgent{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			mgr := newTestManager()
+			mgr.ServiceProvider = tc.sp
+
+			err := mgr.InitializeModules(map[string]ModuleSpec{
+				"a": {Source: "fake_i2c", Config: json.RawMessage(`{}`)},
+				"b": fakeSpec(""),
+			}, false)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tc.wantErr)
+			}
+			if tc.wantErr && !strings.Contains(err.Error(), "requires the i2c subsystem") {
+				t.Errorf("error doesn't name the missing subsystem: %v", err)
+			}
+			if got := mgr.RequiresSubsystem(SubsystemI2C); got != !tc.wantErr {
+				t.Errorf("RequiresSubsystem(i2c) = %v, want %v", got, !tc.wantErr)
+			}
+			if mgr.RequiresSubsystem(SubsystemSPI) {
+				t.Error("RequiresSubsystem(spi) = true with no SPI modules")
+			}
+		})
+	}
+}
+
+func TestInitializeModulesOverLimitTouchesNothing(t *testing.T) {
+	mgr := newTestManager()
+	mgr.MaxModules = 2
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+
+	before := fakeInitializations.Load()
+	err := mgr.InitializeModules(map[string]ModuleSpec{"b": fakeSpec(""), "c": fakeSpec("")}, false)
+	if err == nil || !strings.Contains(err.Error(), "exceeding the limit of 2") {
+		t.Fatalf("got error %v, want the module limit", err)
+	}
+	if n := fakeInitializations.Load() - before; n != 0 {
+		t.Errorf("%d modules were initialized before the limit was checked", n)
+	}
+	if len(mgr.Modules) != 1 {
+		t.Errorf("got %d live modules, want 1", len(mgr.Modules))
+	}
+
+	// replacing an existing module doesn't count against the limit
+	if err := mgr.InitializeModules(map[string]ModuleSpec{"a": fakeSpec(`{"value": 2}`), "b": fakeSpec("")}, false); err != nil {
+		t.Errorf("initializing up to the limit failed: %v", err)
+	}
+}
+
+func TestInitializeModulesLogsSummary(t *testing.T) {
+	testPin(t, "SUMMARY_PIN")
+	var logs bytes.Buffer
+	mgr := NewManagerAgent(&ServiceAgent{}, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"relay": {Source: "relay", Config: json.RawMessage(`{"pin": "SUMMARY_PIN"}`)},
+		"fake":  fakeSpec(""),
+	})
+
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(&logs)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("failed decoding log line: %v", err)
+		}
+		if line["msg"] == "modules initialized" || line["msg"] == "module initialized" {
+			lines = append(lines, line)
+		}
+	}
+
+	want := []map[string]interface{}{
+		{"msg": "modules initialized", "count": 2.0},
+		{"msg": "module initialized", "module": "fake", "source": "fake", "pins": "none"},
+		{"msg": "module initialized", "module": "relay", "source": "relay", "pins": "SUMMARY_PIN"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d summary lines, want %d: %v", len(lines), len(want), lines)
+	}
+	for i, fields := range want {
+		for key, val := range fields {
+			if lines[i][key] != val {
+				t.Errorf("line %d: got %s=%v, want %v", i, key, lines[i][key], val)
+			}
+		}
+	}
+}
+
+func TestInitializationOrder(t *testing.T) {
+	dependsOn := func(deps ...string) ModuleSpec { return ModuleSpec{Source: "fake", DependsOn: deps} }
+
+	for _, tc := range []struct {
+		name    string
+		specs   map[string]ModuleSpec
+		live    map[string]Module
+		want    []string
+		wantErr string
+	}{
+		{
+			name:  "chain",
+			specs: map[string]ModuleSpec{"a": dependsOn("b"), "b": dependsOn("c"), "c": dependsOn()},
+			want:  []string{"c", "b", "a"},
+		},
+		{
+			name:  "live dependency",
+			specs: map[string]ModuleSpec{"a": dependsOn("b")},
+			live:  map[string]Module{"b": &fakeModule{}},
+			want:  []string{"a"},
+		},
+		{
+			name:    "cycle",
+			specs:   map[string]ModuleSpec{"a": dependsOn("b"), "b": dependsOn("c"), "c": dependsOn("a")},
+			wantErr: "module dependency cycle: a -> b -> c -> a",
+		},
+		{
+			name:    "self",
+			specs:   map[string]ModuleSpec{"a": dependsOn("a")},
+			wantErr: "module dependency cycle: a -> a",
+		},
+		{
+			name:    "unknown",
+			specs:   map[string]ModuleSpec{"a": dependsOn("b")},
+			wantErr: "module `a` depends on unknown module `b`",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			order, err := initializationOrder(tc.specs, tc.live)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("got error %v, want %q", err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %v", err)
+			}
+			if strings.Join(order, ",") != strings.Join(tc.want, ",") {
+				t.Errorf("got order %v, want %v", order, tc.want)
+			}
+		})
+	}
+}
+
+func TestInitializeModulesRejectsCycles(t *testing.T) {
+	mgr := newTestManager()
+	a, b := fakeSpec(""), fakeSpec("")
+	a.DependsOn, b.DependsOn = []string{"b"}, []string{"a"}
+
+	before := fakeInitializations.Load()
+	var iErr InputError
+	if err := mgr.InitializeModules(map[string]ModuleSpec{"a": a, "b": b}, false); !errors.As(err, &iErr) {
+		t.Fatalf("got %v, want an InputError", err)
+	}
+	if n := fakeInitializations.Load() - before; n != 0 || len(mgr.Modules) != 0 {
+		t.Errorf("a cycle initialized %d modules", n)
+	}
+}
+
+func TestShutdownStopsEverything(t *testing.T) {
+	pin := testPin(t, "SHUTDOWN_PIN")
+	bus := &fakeBus{}
+	mgr := newTestManager()
+	mgr.ServiceProvider = &ServiceAgent{defaultI2CBus: bus}
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"a":      fakeSpec(""),
+		"wedged": fakeSpec(`{"stop_error": "wedged"}`),
+		"relay":  {Source: "relay", Config: json.RawMessage(`{"pin": "SHUTDOWN_PIN", "safe_state": "off"}`)},
+	})
+	fakes := []*fakeModule{mgr.Modules["a"].(*fakeModule), mgr.Modules["wedged"].(*fakeModule)}
+	if _, err := mgr.Act("relay", "set", mgr.Binder([]byte(`{"high": true}`))); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+
+	if err := mgr.Shutdown(); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	for _, mod := range fakes {
+		if !mod.isStopped() {
+			t.Error("a module wasn't stopped")
+		}
+	}
+	if level(pin) != gpio.Low {
+		t.Error("relay wasn't driven to its safe state")
+	}
+	if len(mgr.Modules) != 0 {
+		t.Errorf("%d modules are still live", len(mgr.Modules))
+	}
+	if !bus.closed {
+		t.Error("the I2C bus wasn't closed")
+	}
+}
+
+// unlistedModule doesn't say what its actions are.
+type unlistedModule struct{}
+
+func (unlistedModule) Initialize(ServiceProvider, Binder) error { return nil }
+func (unlistedModule) Act(string, Binder) (interface{}, error)  { return nil, nil }
+func (unlistedModule) Stop() error                              { return nil }
+
+func TestCheckActionListsActions(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		mod    Module
+		action string
+		want   string
+	}{
+		{"relay", &RelayModule{}, "flip", "no such action `flip`, expected one of: pulse, set, toggle"},
+		{"relay known", &RelayModule{}, "toggle", ""},
+		{"actioner", &fakeModule{}, "nope", "no such action `nope`, expected one of: fail, read, sleep"},
+		{"any action", &EchoModule{}, "nope", ""},
+		{"unlisted", unlistedModule{}, "nope", ""},
+	} {
+		err := checkAction(tc.mod, tc.action)
+		var nfErr NotFoundError
+		if tc.want == "" && err != nil || tc.want != "" && (!errors.As(err, &nfErr) || err.Error() != tc.want) {
+			t.Errorf("%s: got %v, want %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestHTGCalibrationSurvivesRestart(t *testing.T) {
+	state := &StateFile{Path: filepath.Join(t.TempDir(), "state.json")}
+
+	// start is what main does at startup: restore the saved modules, and
+	// save again whenever an action changes one
+	start := func() *ManagerAgent {
+		mgr := newTestManager()
+		mgr.ServiceProvider = &ServiceAgent{defaultI2CBus: &i2ctest.Playback{DontPanic: true}}
+		saved, err := state.Load()
+		if err != nil {
+			t.Fatalf("failed loading state: %v", err)
+		}
+		for name, err := range mgr.InitializeEach(saved.Modules) {
+			t.Fatalf("failed restoring `%s`: %v", name, err)
+		}
+		mgr.OnConfigChange = func() { saveModules(mgr, state) }
+		return mgr
+	}
+
+	mgr := start()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"htg": {Source: "htg3535ch", Config: json.RawMessage(`{"temperature_adc_channel": 0, "humidity_adc_channel": 1}`)},
+	})
+	saveModules(mgr, state)
+	if _, err := mgr.Act("htg", "calibrate", mgr.Binder([]byte(`{"rh_adjustment": 4.5}`))); err != nil {
+		t.Fatalf("calibrate failed: %v", err)
+	}
+
+	restarted := start()
+	result, err := restarted.Act("htg", "calibration", restarted.Binder(nil))
+	if err != nil {
+		t.Fatalf("calibration failed: %v", err)
+	}
+	if want := (HTGCalibrateResponse{RHAdjustment: 4.5}); result != want {
+		t.Errorf("got %+v after restarting, want %+v", result, want)
+	}
+}
+
+func TestHTGCalibrationSurvivesModuleRestart(t *testing.T) {
+	mgr := newTestManager()
+	mgr.ServiceProvider = &ServiceAgent{defaultI2CBus: &i2ctest.Playback{DontPanic: true}}
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"htg": {Source: "htg3535ch", Config: json.RawMessage(`{"temperature_adc_channel": 0, "humidity_adc_channel": 1}`)},
+	})
+	if _, err := mgr.Act("htg", "calibrate", mgr.Binder([]byte(`{"rh_adjustment": 4.5}`))); err != nil {
+		t.Fatalf("calibrate failed: %v", err)
+	}
+	if _, err := mgr.Act("htg", RestartAction, mgr.Binder(nil)); err != nil {
+		t.Fatalf("restart failed: %v", err)
+	}
+
+	result, err := mgr.Act("htg", "calibration", mgr.Binder(nil))
+	if err != nil {
+		t.Fatalf("calibration failed: %v", err)
+	}
+	if want := (HTGCalibrateResponse{RHAdjustment: 4.5}); result != want {
+		t.Errorf("got %+v after restarting, want %+v", result, want)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ActionMetrics tracks request counts, error counts and latency for every
+// module action performed through an ActionRunner, along with the latest
+// reading of every scheduled action. The metrics are keyed by module and
+// action name rather than by module instance, so they carry across
+// re-initialization.
+type ActionMetrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	errors   *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+
+	// readings holds the latest numeric result of each scheduled action,
+	// so that scraping never triggers a hardware read of its own
+	readings *prometheus.GaugeVec
+}
+
+// UnknownMetricLabel stands in for a module or action that doesn't resolve,
+// so that clients can't create a series for every name they make up.
+const UnknownMetricLabel = "unknown"
+
+func NewActionMetrics() *ActionMetrics {
+	labels := []string{"module", "action"}
+	m := &ActionMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pihub",
+			Name:      "action_requests_total",
+			Help:      "Number of module actions performed.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "pihub",
+			Name:      "action_errors_total",
+			Help:      "Number of module actions that returned an error.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "pihub",
+			Name:      "action_duration_seconds",
+			Help:      "Time taken to perform module actions.",
+			Buckets:   prometheus.DefBuckets,
+		}, labels),
+		readings: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "pihub",
+			Name:      "reading",
+			Help:      "Latest numeric result of each scheduled module action.",
+		}, labels),
+	}
+	m.registry.MustRegister(m.requests, m.errors, m.latency, m.readings)
+	return m
+}
+
+// Observe performs act and records its outcome against module and action.
+func (m *ActionMetrics) Observe(module, action string, act func() (interface{}, error)) (interface{}, error) {
+	start := time.Now()
+	result, err := act()
+
+	m.requests.WithLabelValues(module, action).Inc()
+	m.latency.WithLabelValues(module, action).Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.errors.WithLabelValues(module, action).Inc()
+	}
+	return result, err
+}
+
+// RecordReading sets the reading gauge for module and action to result, if
+// it's a number. Other results are ignored.
+func (m *ActionMetrics) RecordReading(module, action string, result interface{}) {
+	var val float64
+	switch r := result.(type) {
+	case float64:
+		val = r
+	case float32:
+		val = float64(r)
+	case int:
+		val = float64(r)
+	case int64:
+		val = float64(r)
+	case uint64:
+		val = float64(r)
+	default:
+		return
+	}
+	m.readings.WithLabelValues(module, action).Set(val)
+}
+
+// ForgetReading removes the reading gauge for module and action, once
+// nothing updates it any more.
+func (m *ActionMetrics) ForgetReading(module, action string) {
+	m.readings.DeleteLabelValues(module, action)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *ActionMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
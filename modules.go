@@ -2,27 +2,71 @@ package main
 
 import (
 	"periph.io/x/periph/conn/gpio"
-	"periph.io/x/periph/conn/gpio/gpioreg"
 	"periph.io/x/periph/conn/i2c"
 	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/pin"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/devices/bmxx80"
 	"periph.io/x/periph/experimental/conn/analog"
 	"periph.io/x/periph/experimental/devices/ads1x15"
 
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/xanderflood/pihub/pkg/htg3535ch"
 )
 
 ////////////////////////
 // The module library //
-type EchoModule struct{}
+type EchoModule struct {
+	config EchoModuleConfig
+}
 
-func (*EchoModule) Stop() error { return nil }
+//EchoModuleConfig turns the echo module into a fixture for exercising
+//clients and the HTTP error mapping.
+type EchoModuleConfig struct {
+	// Errors maps an action name to the kind of error it should fail with:
+	// "input" (mapped to a 400) or "internal" (mapped to a 500).
+	Errors map[string]string `json:"errors"`
+
+	// PayloadBytes adds a payload of this many bytes to every response.
+	PayloadBytes int `json:"payload_bytes"`
+}
 
-func (e *EchoModule) Initialize(sp ServiceProvider, _ Binder) error {
+//MaxEchoPayloadBytes keeps an echo fixture from exhausting memory.
+const MaxEchoPayloadBytes = 16 << 20
+
+func (c EchoModuleConfig) Validate() error {
+	for action, kind := range c.Errors {
+		if kind != "input" && kind != "internal" {
+			return fmt.Errorf("unknown error kind `%s` for action `%s`, expected `input` or `internal`", kind, action)
+		}
+	}
+	if c.PayloadBytes < 0 || c.PayloadBytes > MaxEchoPayloadBytes {
+		return fmt.Errorf("payload_bytes must be between 0 and %d", MaxEchoPayloadBytes)
+	}
 	return nil
 }
+
+func (*EchoModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config:    EchoModuleConfig{},
+		AnyAction: true,
+	}
+}
+
+func (*EchoModule) Stop() error { return nil }
+
+func (e *EchoModule) Initialize(sp ServiceProvider, binder Binder) error {
+	return binder.BindData(&e.config)
+}
 func (e *EchoModule) Act(action string, body Binder) (interface{}, error) {
 	var reqVal interface{}
 	request := &reqVal
@@ -30,262 +74,2657 @@ func (e *EchoModule) Act(action string, body Binder) (interface{}, error) {
 		return nil, err
 	}
 
-	return map[string]interface{}{
+	switch e.config.Errors[action] {
+	case "input":
+		return nil, InputError{error: fmt.Errorf("injected input error for action `%s`", action)}
+	case "internal":
+		return nil, fmt.Errorf("injected internal error for action `%s`", action)
+	}
+
+	resp := map[string]interface{}{
 		"action": action,
 		"config": request,
-	}, nil
+	}
+	if e.config.PayloadBytes > 0 {
+		resp["payload"] = strings.Repeat("x", e.config.PayloadBytes)
+	}
+	return resp, nil
+}
+
+type RelayModule struct {
+	pin      gpio.PinOut
+	level    gpio.Level
+	readback bool
+	inverted bool
+
+	// safe is the logical level driven on Stop, if hasSafe is set.
+	safe    gpio.Level
+	hasSafe bool
+
+	minInterval time.Duration
+	lastActed   time.Time
+
+	// config is kept for snapshots, with Pin following any rebind.
+	config RelayModuleConfig
+
+	mu sync.Mutex
+}
+type RelayModuleConfig struct {
+	Pin string `json:"pin"`
+
+	// Inverted is for active-low relay boards, which switch on when the pin
+	// is driven low. Levels in requests and responses stay logical, so high
+	// always means on.
+	Inverted bool `json:"inverted"`
+
+	// Readback makes "set" read the pin back after driving it and report
+	// whether it reached the commanded level.
+	Readback bool `json:"readback"`
+
+	// InitialState is the logical state, "on" or "off", that the relay is
+	// driven to when the module starts.
+	InitialState string `json:"initial_state"`
+
+	// SafeState, if set, is the logical state, "on" or "off", that the relay
+	// is driven to when the module stops. It is left as it was otherwise.
+	SafeState string `json:"safe_state"`
+
+	// MinIntervalMS, if set, rejects any action arriving less than this long
+	// after the last one, to keep a misbehaving client from chattering the
+	// relay.
+	MinIntervalMS int `json:"min_interval_ms"`
+}
+
+func (c *RelayModuleConfig) Default() {
+	c.InitialState = "off"
+}
+func (c RelayModuleConfig) Validate() error {
+	if c.MinIntervalMS < 0 {
+		return errors.New("min_interval_ms must not be negative")
+	}
+	if _, err := parseRelayState("initial_state", c.InitialState); err != nil {
+		return err
+	}
+	if c.SafeState != "" {
+		if _, err := parseRelayState("safe_state", c.SafeState); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRelayState(field, state string) (gpio.Level, error) {
+	switch state {
+	case "on":
+		return gpio.High, nil
+	case "off":
+		return gpio.Low, nil
+	default:
+		return gpio.Low, fmt.Errorf("%s must be `on` or `off`, got `%s`", field, state)
+	}
+}
+
+type RelaySetRequest struct {
+	High bool `json:"high"`
+}
+
+func (r RelaySetRequest) Level() gpio.Level {
+	return gpio.Level(r.High)
+}
+
+//MaxRelayPulse bounds how long a pulse can hold the module.
+const MaxRelayPulse = 10 * time.Second
+
+type RelayPulseRequest struct {
+	MS   int  `json:"ms"`
+	High bool `json:"high"`
+}
+
+func (r RelayPulseRequest) Validate() error {
+	if r.MS <= 0 {
+		return errors.New("ms must be positive")
+	}
+	if r.duration() > MaxRelayPulse {
+		return fmt.Errorf("ms must be at most %d", MaxRelayPulse.Milliseconds())
+	}
+	return nil
+}
+
+func (r RelayPulseRequest) Level() gpio.Level {
+	return gpio.Level(r.High)
+}
+
+func (r RelayPulseRequest) duration() time.Duration {
+	return time.Duration(r.MS) * time.Millisecond
+}
+
+type RelaySetResponse struct {
+	Commanded         bool  `json:"commanded"`
+	ReadbackAvailable bool  `json:"readback_available"`
+	Observed          *bool `json:"observed,omitempty"`
+	Mismatch          bool  `json:"mismatch"`
+}
+
+func (*RelayModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: RelayModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "set", Request: RelaySetRequest{}},
+			{Name: "toggle"},
+			{Name: "pulse", Request: RelayPulseRequest{}},
+		},
+	}
+}
+
+func (*RelayModule) Requires() []string { return []string{SubsystemGPIO} }
+
+//Stop drives the relay to its safe state, if one is configured.
+func (m *RelayModule) Stop() error {
+	if !m.hasSafe {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.set(m.safe)
+}
+
+func (m *RelayModule) Pins() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return []string{realPinName(m.pin)}
+}
+
+func (m *RelayModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &RelayModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	pin, err := sp.GetGPIOByName(config.Pin)
+	if err != nil {
+		return err
+	}
+	if pin == nil {
+		return fmt.Errorf("Failed to find pin `%s`", config.Pin)
+	}
+	initial, _ := parseRelayState("initial_state", config.InitialState)
+	if config.SafeState != "" {
+		m.safe, _ = parseRelayState("safe_state", config.SafeState)
+		m.hasSafe = true
+	}
+
+	m.inverted = config.Inverted
+	if err := pin.Out(m.physical(initial)); err != nil {
+		return err
+	}
+	m.pin = pin
+	m.level = initial
+	m.readback = config.Readback
+	m.minInterval = time.Duration(config.MinIntervalMS) * time.Millisecond
+	m.config = *config
+
+	return nil
+}
+func (m *RelayModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "set":
+		var request = &RelaySetRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err := m.throttle(); err != nil {
+			return nil, err
+		}
+		if err := m.set(request.Level()); err != nil {
+			return nil, err
+		}
+
+		if !m.readback {
+			return nil, nil
+		}
+		return m.readBack(), nil
+	case "toggle":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err := m.throttle(); err != nil {
+			return nil, err
+		}
+		if err := m.set(!m.level); err != nil {
+			return nil, err
+		}
+		return m.response(), nil
+	case "pulse":
+		var request = &RelayPulseRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		// holding the lock for the whole pulse keeps pulses from overlapping
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err := m.throttle(); err != nil {
+			return nil, err
+		}
+		if err := m.pulse(*request); err != nil {
+			return nil, err
+		}
+		return m.response(), nil
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+//throttle rejects an action arriving within minInterval of the last one,
+//and otherwise records it. The caller must hold m.mu.
+func (m *RelayModule) throttle() error {
+	now := time.Now()
+	if remaining := m.lastActed.Add(m.minInterval).Sub(now); m.minInterval > 0 && remaining > 0 {
+		return RateLimitError{Remaining: remaining}
+	}
+	m.lastActed = now
+	return nil
+}
+
+//set drives the relay to a logical level. The caller must hold m.mu.
+func (m *RelayModule) set(level gpio.Level) error {
+	if err := m.pin.Out(m.physical(level)); err != nil {
+		return err
+	}
+	m.level = level
+	return nil
+}
+
+//pulse drives the relay to the requested level, then back to the level it
+//was at before. The caller must hold m.mu.
+func (m *RelayModule) pulse(request RelayPulseRequest) error {
+	previous := m.level
+	if err := m.set(request.Level()); err != nil {
+		return err
+	}
+	time.Sleep(request.duration())
+	return m.set(previous)
+}
+
+//response reports the relay's level after a toggle or pulse, read back
+//from the pin if the module is configured to.
+func (m *RelayModule) response() RelaySetResponse {
+	if !m.readback {
+		return RelaySetResponse{Commanded: bool(m.level)}
+	}
+	return m.readBack()
+}
+
+//readBack compares the pin's observed level with the last commanded one,
+//if the pin can be read while driven as an output.
+func (m *RelayModule) readBack() RelaySetResponse {
+	resp := RelaySetResponse{Commanded: bool(m.level)}
+
+	in, ok := m.pin.(gpio.PinIn)
+	if !ok {
+		return resp
+	}
+
+	observed := bool(m.logical(in.Read()))
+	resp.ReadbackAvailable = true
+	resp.Observed = &observed
+	resp.Mismatch = observed != resp.Commanded
+	return resp
+}
+
+//RebindPin moves the relay to another pin, carrying over its current level.
+func (m *RelayModule) RebindPin(sp ServiceProvider, name string) error {
+	pin, err := sp.GetGPIOByName(name)
+	if err != nil {
+		return err
+	}
+	if pin == nil {
+		return InputError{error: fmt.Errorf("Failed to find pin `%s`", name)}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	//set up the new pin first, so that a failure leaves the old one in charge
+	if err := pin.Out(m.physical(m.level)); err != nil {
+		return err
+	}
+	if err := m.pin.Halt(); err != nil {
+		_ = pin.Halt()
+		return fmt.Errorf("failed halting old pin: %w", err)
+	}
+	m.pin = pin
+	m.config.Pin = name
+
+	return nil
+}
+
+//SnapshotConfig reports the module's config with the pin it's bound to now.
+func (m *RelayModule) SnapshotConfig() interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config
+}
+
+//physical converts a logical level to the level to drive the pin at.
+func (m *RelayModule) physical(level gpio.Level) gpio.Level {
+	return level != gpio.Level(m.inverted)
+}
+
+//logical converts a level read from the pin back to a logical level.
+func (m *RelayModule) logical(level gpio.Level) gpio.Level {
+	return m.physical(level)
+}
+
+//realPinName resolves aliases like "20" to the name of the pin they point
+//at, so that two names for the same pin compare equal.
+func realPinName(p pin.Pin) string {
+	if r, ok := p.(gpio.RealPin); ok {
+		return r.Real().Name()
+	}
+	return p.Name()
+}
+
+type I2CModule struct {
+	bus  i2c.Bus
+	dvc  I2CDevice
+	addr uint16
+
+	mu sync.Mutex
+}
+type I2CModuleConfig struct {
+	Address uint16 `json:"address"`
+}
+type I2CTransactRequest struct {
+	Bytes          Bytes `json:"bytes"`
+	ResponseLength int   `json:"resp_len"`
+}
+
+func (r I2CTransactRequest) Validate() error {
+	if r.ResponseLength < 0 {
+		return errors.New("resp_len must not be negative")
+	}
+	return nil
+}
+
+type I2CWriteRequest struct {
+	Bytes Bytes `json:"bytes"`
+}
+
+func (r I2CWriteRequest) Validate() error {
+	if len(r.Bytes) == 0 {
+		return errors.New("bytes must not be empty")
+	}
+	return nil
+}
+
+type I2CReadRequest struct {
+	Length int `json:"length"`
+}
+
+func (r I2CReadRequest) Validate() error {
+	if r.Length <= 0 {
+		return errors.New("length must be positive")
+	}
+	return nil
+}
+
+//Bytes decodes from either a base64 string, as encoding/json does for a
+//[]byte, or an array of integers from 0 to 255, like [64, 0].
+type Bytes []byte
+
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	var encoded []byte
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		*b = encoded
+		return nil
+	}
+
+	var ints []int
+	if err := json.Unmarshal(data, &ints); err != nil {
+		return errors.New("bytes must be a base64 string or an array of integers from 0 to 255")
+	}
+	decoded := make([]byte, len(ints))
+	for i, v := range ints {
+		if v < 0 || v > 255 {
+			return fmt.Errorf("byte %d is %d, which is outside 0-255", i, v)
+		}
+		decoded[i] = byte(v)
+	}
+	*b = decoded
+	return nil
+}
+
+type I2CSetAddressRequest struct {
+	Address uint16 `json:"address"`
+}
+
+func (r I2CSetAddressRequest) Validate() error {
+	return validateI2CAddress(r.Address)
+}
+
+//validateI2CAddress rejects anything outside the usable 7-bit address range.
+func validateI2CAddress(addr uint16) error {
+	if addr < 0x03 || addr > 0x77 {
+		return fmt.Errorf("i2c address %#x is outside the usable range 0x03-0x77", addr)
+	}
+	return nil
+}
+
+func (*I2CModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: I2CModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "transact", Request: I2CTransactRequest{}},
+			{Name: "write", Request: I2CWriteRequest{}},
+			{Name: "read", Request: I2CReadRequest{}},
+			{Name: "set_address", Request: I2CSetAddressRequest{}},
+		},
+	}
+}
+
+func (*I2CModule) Requires() []string { return []string{SubsystemI2C} }
+func (*I2CModule) Stop() error        { return nil }
+
+func (m *I2CModule) Pins() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return []string{fmt.Sprintf("I2C(%#x)", m.addr)}
+}
+
+func (m *I2CModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &I2CModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	bus, err := sp.GetDefaultI2CBus()
+	if err != nil {
+		return fmt.Errorf("failed getting i2c device: %w", err)
+	}
+	m.bus = bus
+	m.setAddress(config.Address)
+
+	return nil
+}
+func (m *I2CModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "transact":
+		var request = &I2CTransactRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		resp := make([]byte, request.ResponseLength)
+		if err := m.dvc.Tx(request.Bytes, resp); err != nil {
+			return nil, fmt.Errorf("failed executing I2C transaction: %w", err)
+		}
+
+		return map[string]interface{}{
+			"response": resp,
+		}, nil
+	case "write":
+		var request = &I2CWriteRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if err := m.dvc.Tx(request.Bytes, nil); err != nil {
+			return nil, fmt.Errorf("failed writing to I2C device: %w", err)
+		}
+		return nil, nil
+	case "read":
+		var request = &I2CReadRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		resp := make([]byte, request.Length)
+		if err := m.dvc.Tx(nil, resp); err != nil {
+			return nil, fmt.Errorf("failed reading from I2C device: %w", err)
+		}
+		return map[string]interface{}{
+			"response": resp,
+		}, nil
+	case "set_address":
+		var request = &I2CSetAddressRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		m.setAddress(request.Address)
+		return map[string]interface{}{
+			"address": m.addr,
+		}, nil
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+//setAddress retargets the module at a new device on the same bus. Callers
+//outside Initialize must hold m.mu.
+func (m *I2CModule) setAddress(addr uint16) {
+	m.dvc = &i2c.Dev{Bus: m.bus, Addr: addr}
+	m.addr = addr
+}
+
+type ADS1115Module struct {
+	ads      *ads1x15.Dev
+	pin      analog.PinADC
+	channel  int
+	states   AnalogThresholds
+	transfer TransferTable
+
+	// sampler keeps the latest reading in continuous mode, and is nil in
+	// single mode.
+	sampler *adcSampler
+
+	// channels caches a pin per single-ended channel for "read_all", which
+	// may run concurrently.
+	settings ADCSettings
+	discard  int
+	chMu     sync.Mutex
+	channels map[ads1x15.Channel]analog.PinADC
+}
+type ADS1115ModuleConfig struct {
+	Ch     int              `json:"channel_mask"`
+	States AnalogThresholds `json:"states"`
+
+	// Mode is "single" to convert on every read, or "continuous" to sample
+	// in the background at frequency_hz so that "read" returns the latest
+	// sample immediately.
+	Mode string `json:"mode"`
+
+	// DiscardConversions is the number of conversions thrown away before each
+	// read, giving the ADC time to settle after a channel switch.
+	DiscardConversions int `json:"discard_conversions"`
+
+	// Transfer maps the raw voltage to engineering units. When set, readings
+	// and state thresholds are in those units rather than volts.
+	Transfer TransferTable `json:"transfer"`
+
+	ADCSettings
+}
+
+func (c *ADS1115ModuleConfig) Default() {
+	c.Mode = ADS1115ModeSingle
+	c.ADCSettings = ADCSettings{
+		MaxVoltage:  DefaultADCMaxVoltage,
+		FrequencyHZ: DefaultADCFrequencyHZ,
+		Quality:     ADCQualitySaveEnergy,
+	}
+}
+
+func (c ADS1115ModuleConfig) Validate() error {
+	if c.DiscardConversions < 0 {
+		return errors.New("discard_conversions must not be negative")
+	}
+	if c.Mode != ADS1115ModeSingle && c.Mode != ADS1115ModeContinuous {
+		return fmt.Errorf("mode must be `%s` or `%s`", ADS1115ModeSingle, ADS1115ModeContinuous)
+	}
+	if err := c.ADCSettings.Validate(); err != nil {
+		return err
+	}
+	if err := c.Transfer.Validate(); err != nil {
+		return err
+	}
+	return c.States.Validate()
+}
+
+const (
+	ADS1115ModeSingle     = "single"
+	ADS1115ModeContinuous = "continuous"
+)
+
+//ADCPGARanges are the full-scale voltages supported by the ADS1115's
+//programmable gain amplifier.
+var ADCPGARanges = []float64{6.144, 4.096, 2.048, 1.024, 0.512, 0.256}
+
+const (
+	//DefaultADCMaxVoltage is the widest PGA range, which is the one a 5V
+	//full scale has always resolved to.
+	DefaultADCMaxVoltage  = 6.144
+	DefaultADCFrequencyHZ = 1
+	MaxADCFrequencyHZ     = 860
+
+	ADCQualitySaveEnergy  = "save_energy"
+	ADCQualityBestQuality = "best_quality"
+)
+
+//ADCSettings selects the gain, data rate and conversion quality used to
+//sample an ADS1115 channel.
+type ADCSettings struct {
+	MaxVoltage  float64 `json:"max_voltage"`
+	FrequencyHZ float64 `json:"frequency_hz"`
+	Quality     string  `json:"quality"`
+}
+
+func (s ADCSettings) Validate() error {
+	if !s.validRange() {
+		return fmt.Errorf("max_voltage must be one of %v", ADCPGARanges)
+	}
+	if s.FrequencyHZ <= 0 || s.FrequencyHZ > MaxADCFrequencyHZ {
+		return fmt.Errorf("frequency_hz must be greater than 0 and at most %v", MaxADCFrequencyHZ)
+	}
+	switch s.Quality {
+	case ADCQualitySaveEnergy, ADCQualityBestQuality:
+	default:
+		return fmt.Errorf("quality must be `%s` or `%s`", ADCQualitySaveEnergy, ADCQualityBestQuality)
+	}
+	return nil
+}
+
+func (s ADCSettings) validRange() bool {
+	for _, v := range ADCPGARanges {
+		if s.MaxVoltage == v {
+			return true
+		}
+	}
+	return false
+}
+
+//pinForChannel opens ch on ads with these settings.
+func (s ADCSettings) pinForChannel(ads *ads1x15.Dev, ch int) (analog.PinADC, error) {
+	quality := ads1x15.SaveEnergy
+	if s.Quality == ADCQualityBestQuality {
+		quality = ads1x15.BestQuality
+	}
+
+	return ads.PinForChannel(ads1x15.Channel(ch),
+		physic.ElectricPotential(s.MaxVoltage*float64(physic.Volt)),
+		physic.Frequency(s.FrequencyHZ*float64(physic.Hertz)),
+		quality)
+}
+
+//TransferPoint is one breakpoint of a TransferTable.
+type TransferPoint struct {
+	Volts float64 `json:"volts"`
+	Value float64 `json:"value"`
+}
+
+//TransferTable is a piecewise-linear transfer function over breakpoints
+//sorted by strictly increasing Volts. Voltages outside the table are
+//clamped to its first or last value.
+type TransferTable []TransferPoint
+
+func (t TransferTable) Validate() error {
+	if len(t) == 1 {
+		return errors.New("a transfer table needs at least two points")
+	}
+	for i := 1; i < len(t); i++ {
+		if t[i].Volts <= t[i-1].Volts {
+			return fmt.Errorf("transfer table volts must be strictly increasing, but %v follows %v", t[i].Volts, t[i-1].Volts)
+		}
+	}
+	return nil
+}
+
+//Apply interpolates the value for v. An empty table is the identity.
+func (t TransferTable) Apply(v float64) float64 {
+	if len(t) == 0 {
+		return v
+	}
+	if v <= t[0].Volts {
+		return t[0].Value
+	}
+	for i := 1; i < len(t); i++ {
+		if v <= t[i].Volts {
+			lo, hi := t[i-1], t[i]
+			return lo.Value + (v-lo.Volts)*(hi.Value-lo.Value)/(hi.Volts-lo.Volts)
+		}
+	}
+	return t[len(t)-1].Value
+}
+
+type ADS1115ReadRequest struct {
+	FormatRequest
+
+	// FullScale adds the reading's percentage of the channel's full-scale
+	// range, which makes a saturated input easy to spot.
+	FullScale bool `json:"full_scale"`
+
+	// Timestamp adds when the sample was taken, which in continuous mode may
+	// be up to a period before the read. It's opt-in so that a plain read
+	// stays a bare number, which anomaly detection and the pihub_reading
+	// gauge depend on.
+	Timestamp bool `json:"timestamp"`
+}
+
+//ADS1115Reading is the response to a read that asks for more than the bare
+//value, and has the same shape in single and continuous mode.
+type ADS1115Reading struct {
+	Value float64 `json:"value"`
+
+	// Formatted and PercentOfFullScale always describe the raw voltage, even
+	// when a transfer table is configured.
+	Formatted          string   `json:"formatted,omitempty"`
+	PercentOfFullScale *float64 `json:"percent_of_full_scale,omitempty"`
+
+	// Timestamp is when the sample was taken.
+	Timestamp *Timestamp `json:"timestamp,omitempty"`
+}
+
+// ADS1115ReadAllResponse holds the voltage of each single-ended channel that
+// could be read, keyed by channel number, and the error for each that
+// couldn't.
+type ADS1115ReadAllResponse struct {
+	Values map[string]float64 `json:"values"`
+	Errors map[string]string  `json:"errors,omitempty"`
+}
+
+type ADS1115ConfigResponse struct {
+	Channel       int              `json:"channel_mask"`
+	RangeMinVolts float64          `json:"range_min_volts"`
+	RangeMaxVolts float64          `json:"range_max_volts"`
+	States        AnalogThresholds `json:"states"`
+}
+
+//MaxReadUntilTimeout bounds how long a read_until can hold the module.
+const MaxReadUntilTimeout = time.Minute
+
+type ADS1115ReadUntilRequest struct {
+	Threshold  float64 `json:"threshold"`
+	Comparison string  `json:"comparison"`
+	IntervalMS int     `json:"interval_ms"`
+	TimeoutMS  int     `json:"timeout_ms"`
+}
+
+func (r *ADS1115ReadUntilRequest) Default() {
+	r.Comparison = "above"
+	r.IntervalMS = 10
+	r.TimeoutMS = 1000
+}
+func (r ADS1115ReadUntilRequest) Validate() error {
+	if r.Comparison != "above" && r.Comparison != "below" {
+		return fmt.Errorf("comparison must be `above` or `below`, got `%s`", r.Comparison)
+	}
+	if r.IntervalMS < 0 {
+		return errors.New("interval_ms must not be negative")
+	}
+	if r.TimeoutMS <= 0 || time.Duration(r.TimeoutMS)*time.Millisecond > MaxReadUntilTimeout {
+		return fmt.Errorf("timeout_ms must be positive and at most %d", MaxReadUntilTimeout/time.Millisecond)
+	}
+	return nil
+}
+
+//Met reports whether val satisfies the requested condition. "above" and
+//"below" are both inclusive of the threshold.
+func (r ADS1115ReadUntilRequest) Met(val float64) bool {
+	if r.Comparison == "below" {
+		return val <= r.Threshold
+	}
+	return val >= r.Threshold
+}
+
+type ADS1115ReadUntilResponse struct {
+	Met       bool    `json:"met"`
+	Value     float64 `json:"value"`
+	Samples   int     `json:"samples"`
+	ElapsedMS float64 `json:"elapsed_ms"`
+}
+
+type ADS1115StateResponse struct {
+	State string  `json:"state"`
+	Value float64 `json:"value"`
+}
+
+//AnalogThreshold labels every reading at or above Min (up to the next
+//threshold) with Label.
+type AnalogThreshold struct {
+	Min   float64 `json:"min"`
+	Label string  `json:"label"`
+}
+
+//AnalogThresholds is an ordered list of thresholds, sorted by strictly
+//increasing Min. The first label also covers readings below its Min.
+type AnalogThresholds []AnalogThreshold
+
+func (ts AnalogThresholds) Validate() error {
+	for i, t := range ts {
+		if t.Label == "" {
+			return fmt.Errorf("state %d has no label", i)
+		}
+		if i > 0 && t.Min <= ts[i-1].Min {
+			return fmt.Errorf("state thresholds must be strictly increasing, but `%s` (%v) follows `%s` (%v)",
+				t.Label, t.Min, ts[i-1].Label, ts[i-1].Min)
+		}
+	}
+	return nil
+}
+
+//Label returns the label for the highest threshold not exceeding val.
+func (ts AnalogThresholds) Label(val float64) string {
+	if len(ts) == 0 {
+		return ""
+	}
+
+	label := ts[0].Label
+	for _, t := range ts[1:] {
+		if val < t.Min {
+			break
+		}
+		label = t.Label
+	}
+	return label
+}
+
+func (*ADS1115Module) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: ADS1115ModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "read", Request: ADS1115ReadRequest{}},
+			{Name: "read_fresh", Request: ADS1115ReadRequest{}},
+			{Name: "read_all"},
+			{Name: "read_until", Request: ADS1115ReadUntilRequest{}},
+			{Name: "config"},
+			{Name: "state"},
+		},
+	}
+}
+
+func (*ADS1115Module) Requires() []string    { return []string{SubsystemI2C} }
+func (*ADS1115Module) DefaultAction() string { return "read" }
+func (m *ADS1115Module) Pins() []string      { return []string{m.pin.Name()} }
+
+func (m *ADS1115Module) Stop() error {
+	if m.sampler != nil {
+		m.sampler.stop()
+	}
+
+	m.chMu.Lock()
+	defer m.chMu.Unlock()
+
+	//halt every pin, even if some fail
+	var errs []error
+	for ch, pin := range m.channels {
+		if err := pin.Halt(); err != nil {
+			errs = append(errs, fmt.Errorf("failed halting channel %d: %w", ch, err))
+		}
+	}
+	if err := m.pin.Halt(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (m *ADS1115Module) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &ADS1115ModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	bus, err := sp.GetDefaultI2CBus()
+	if err != nil {
+		return fmt.Errorf("failed getting i2c device: %w", err)
+	}
+
+	m.ads, err = ads1x15.NewADS1115(bus, &ads1x15.DefaultOpts)
+	if err != nil {
+		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	}
+
+	pin, err := config.pinForChannel(m.ads, config.Ch)
+	if err != nil {
+		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	}
+	m.pin = settle(pin, config.DiscardConversions)
+	m.channel = config.Ch
+	m.states = config.States
+	m.transfer = config.Transfer
+	m.settings = config.ADCSettings
+	m.discard = config.DiscardConversions
+	m.channels = map[ads1x15.Channel]analog.PinADC{}
+
+	if config.Mode == ADS1115ModeContinuous {
+		period := time.Duration(float64(time.Second) / config.FrequencyHZ)
+		m.sampler = startADCSampler(m.pin, period)
+	}
+
+	return nil
+}
+func (m *ADS1115Module) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "read", "read_fresh":
+		var request = &ADS1115ReadRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		v, at, err := m.sample(action == "read_fresh")
+		if err != nil {
+			return nil, err
+		}
+		if !request.Formatted && !request.FullScale && !request.Timestamp {
+			return m.transfer.Apply(volts(v)), nil
+		}
+		reading := m.reading(*request, v)
+		if request.Timestamp {
+			ts := Timestamp(at)
+			reading.Timestamp = &ts
+		}
+		return reading, nil
+	case "read_all":
+		return m.readAll()
+	case "read_until":
+		var request = &ADS1115ReadUntilRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+		return m.readUntil(*request)
+	case "config":
+		min, max := m.pin.Range()
+		return ADS1115ConfigResponse{
+			Channel:       m.channel,
+			RangeMinVolts: volts(min.V),
+			RangeMaxVolts: volts(max.V),
+			States:        m.states,
+		}, nil
+	case "state":
+		if len(m.states) == 0 {
+			return nil, errors.New("no states are configured for this module")
+		}
+
+		val, err := m.read()
+		if err != nil {
+			return nil, err
+		}
+		return ADS1115StateResponse{
+			State: m.states.Label(val),
+			Value: val,
+		}, nil
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+//readAll reads the voltage of each single-ended channel. The transfer table
+//describes only the configured channel, so it isn't applied. A channel that
+//fails is reported in Errors rather than failing the others, unless they all
+//fail.
+func (m *ADS1115Module) readAll() (ADS1115ReadAllResponse, error) {
+	resp := ADS1115ReadAllResponse{Values: map[string]float64{}}
+
+	var lastErr error
+	for i, ch := range []ads1x15.Channel{ads1x15.Channel0, ads1x15.Channel1, ads1x15.Channel2, ads1x15.Channel3} {
+		key := strconv.Itoa(i)
+
+		sample, err := m.readChannel(ch)
+		if err != nil {
+			if resp.Errors == nil {
+				resp.Errors = map[string]string{}
+			}
+			resp.Errors[key] = err.Error()
+			lastErr = err
+			continue
+		}
+		resp.Values[key] = volts(sample.V)
+	}
+
+	if len(resp.Values) == 0 {
+		return ADS1115ReadAllResponse{}, fmt.Errorf("failed reading every channel: %w", lastErr)
+	}
+	return resp, nil
+}
+
+//readChannel reads ch, opening and caching a pin for it on first use.
+func (m *ADS1115Module) readChannel(ch ads1x15.Channel) (analog.Sample, error) {
+	m.chMu.Lock()
+	pin, ok := m.channels[ch]
+	if !ok {
+		opened, err := m.settings.pinForChannel(m.ads, int(ch))
+		if err != nil {
+			m.chMu.Unlock()
+			return analog.Sample{}, err
+		}
+		pin = settle(opened, m.discard)
+		m.channels[ch] = pin
+	}
+	m.chMu.Unlock()
+
+	return pin.Read()
+}
+
+//sample returns the latest background sample in continuous mode, or else
+//converts a new one, along with when it was taken.
+func (m *ADS1115Module) sample(fresh bool) (physic.ElectricPotential, time.Time, error) {
+	if m.sampler != nil && !fresh {
+		if v, at, ok, err := m.sampler.latest(); ok {
+			return v, at, err
+		}
+	}
+	v, err := m.readVoltage()
+	return v, time.Now(), err
+}
+
+//reading builds the response to a read of v.
+func (m *ADS1115Module) reading(request ADS1115ReadRequest, v physic.ElectricPotential) ADS1115Reading {
+	reading := ADS1115Reading{Value: m.transfer.Apply(volts(v))}
+	if request.Formatted {
+		reading.Formatted = v.String()
+	}
+	if request.FullScale {
+		_, max := m.pin.Range()
+		percent := 100 * float64(v) / float64(max.V)
+		reading.PercentOfFullScale = &percent
+	}
+	return reading
+}
+
+//readUntil polls the channel until a reading meets the request's condition
+//or the timeout elapses, returning the last reading either way.
+func (m *ADS1115Module) readUntil(request ADS1115ReadUntilRequest) (ADS1115ReadUntilResponse, error) {
+	start := time.Now()
+	deadline := start.Add(time.Duration(request.TimeoutMS) * time.Millisecond)
+	interval := time.Duration(request.IntervalMS) * time.Millisecond
+
+	var resp ADS1115ReadUntilResponse
+	for {
+		val, err := m.read()
+		if err != nil {
+			return ADS1115ReadUntilResponse{}, err
+		}
+		resp.Value = val
+		resp.Samples++
+
+		if request.Met(val) {
+			resp.Met = true
+			break
+		}
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+
+	resp.ElapsedMS = float64(time.Since(start)) / float64(time.Millisecond)
+	return resp, nil
+}
+
+//read returns the current reading, in engineering units if a transfer
+//table is configured.
+func (m *ADS1115Module) read() (float64, error) {
+	v, err := m.readVoltage()
+	return m.transfer.Apply(volts(v)), err
+}
+func (m *ADS1115Module) readVoltage() (physic.ElectricPotential, error) {
+	sample, err := m.pin.Read()
+	return sample.V, err
+}
+
+func volts(v physic.ElectricPotential) float64 {
+	return float64(v) / float64(physic.Volt)
+}
+
+//FormatRequest lets a read action opt in to a FormattedReading response.
+type FormatRequest struct {
+	Formatted bool `json:"formatted"`
+}
+
+//FormattedReading pairs a numeric reading with periph's human-readable
+//formatting of it, e.g. "23.456°C" or "1.234V".
+type FormattedReading struct {
+	Value     float64 `json:"value"`
+	Formatted string  `json:"formatted"`
+}
+
+//formatReading binds a FormatRequest and returns val as-is, or as a
+//FormattedReading using quantity's formatting if the request asked for it.
+func formatReading(body Binder, val float64, quantity fmt.Stringer) (interface{}, error) {
+	var request = &FormatRequest{}
+	if err := body.BindData(request); err != nil {
+		return nil, err
+	}
+
+	if !request.Formatted {
+		return val, nil
+	}
+	return FormattedReading{
+		Value:     val,
+		Formatted: quantity.String(),
+	}, nil
+}
+
+//settledPin discards a fixed number of conversions before each read, so
+//that a read following a channel switch doesn't report a stale value from
+//the previous channel.
+type settledPin struct {
+	analog.PinADC
+	discard int
+}
+
+func settle(pin analog.PinADC, discard int) analog.PinADC {
+	if discard == 0 {
+		return pin
+	}
+	return settledPin{PinADC: pin, discard: discard}
+}
+
+func (p settledPin) Read() (analog.Sample, error) {
+	for i := 0; i < p.discard; i++ {
+		if _, err := p.PinADC.Read(); err != nil {
+			return analog.Sample{}, err
+		}
+	}
+	return p.PinADC.Read()
+}
+
+//adcSampler reads a pin in the background at a fixed period and keeps the
+//latest outcome.
+type adcSampler struct {
+	halt     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+
+	mu    sync.Mutex
+	value physic.ElectricPotential
+	at    time.Time
+	err   error
+}
+
+func startADCSampler(pin analog.PinADC, period time.Duration) *adcSampler {
+	s := &adcSampler{
+		halt: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run(pin, period)
+	return s
+}
+
+func (s *adcSampler) run(pin analog.PinADC, period time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		sample, err := pin.Read()
+		s.mu.Lock()
+		s.value, s.at, s.err = sample.V, time.Now(), err
+		s.mu.Unlock()
+
+		select {
+		case <-s.halt:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//latest returns the most recent sample and when it was taken, or the error
+//that sample failed with. ok is false until the first sample is taken.
+func (s *adcSampler) latest() (v physic.ElectricPotential, at time.Time, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.value, s.at, !s.at.IsZero(), s.err
+}
+
+//stop halts the sampler and waits for any in-flight read to finish. It's
+//safe to call more than once.
+func (s *adcSampler) stop() {
+	s.stopOnce.Do(func() { close(s.halt) })
+	<-s.done
+}
+
+type HTGModule struct {
+	humidity    analog.PinADC
+	temperature analog.PinADC
+	vcc         analog.PinADC
+
+	tk htg3535ch.TemperatureK
+	rh htg3535ch.Humidity
+
+	config HTGModuleConfig
+
+	// rhAdjustment is read by "rh" and written by "calibrate", which may run
+	// concurrently.
+	mu           sync.Mutex
+	rhAdjustment float64
+}
+type HTGModuleConfig struct {
+	TemperatureADCChannel int     `json:"temperature_adc_channel"`
+	HumidityADCChannel    int     `json:"humidity_adc_channel"`
+	RHAdjustment          float64 `json:"rh_adjustment"`
+
+	// VCCADCChannel optionally measures the sensor's supply, so that the
+	// temperature reading isn't biased by a supply that sags below 5V. The
+	// supply must be within max_voltage.
+	VCCADCChannel *int `json:"vcc_adc_channel"`
+
+	// DiscardConversions is the number of conversions thrown away before each
+	// read. Since the module alternates between the temperature and humidity
+	// channels, this keeps one channel's value from bleeding into the other.
+	DiscardConversions int `json:"discard_conversions"`
+
+	ADCSettings
+}
+
+func (c *HTGModuleConfig) Default() {
+	c.ADCSettings = ADCSettings{
+		MaxVoltage:  DefaultADCMaxVoltage,
+		FrequencyHZ: DefaultADCFrequencyHZ,
+		Quality:     ADCQualityBestQuality,
+	}
+}
+
+func (c HTGModuleConfig) Validate() error {
+	if c.DiscardConversions < 0 {
+		return errors.New("discard_conversions must not be negative")
+	}
+	if c.VCCADCChannel != nil {
+		if ch := *c.VCCADCChannel; ch == c.TemperatureADCChannel || ch == c.HumidityADCChannel {
+			return fmt.Errorf("vcc_adc_channel %d is already used for temperature or humidity", ch)
+		}
+	}
+	return c.ADCSettings.Validate()
+}
+
+func (*HTGModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: HTGModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "rh", Request: FormatRequest{}},
+			{Name: "tk", Request: FormatRequest{}},
+			{Name: "tc", Request: FormatRequest{}},
+			{Name: "tf", Request: FormatRequest{}},
+			{Name: "resistance"},
+			{Name: "calibrate", Request: HTGCalibrateRequest{}},
+			{Name: "calibration"},
+		},
+	}
+}
+
+func (*HTGModule) Requires() []string    { return []string{SubsystemI2C} }
+func (*HTGModule) DefaultAction() string { return "rh" }
+func (m *HTGModule) Pins() []string {
+	pins := []string{m.temperature.Name(), m.humidity.Name()}
+	if m.vcc != nil {
+		pins = append(pins, m.vcc.Name())
+	}
+	return pins
+}
+
+func (m *HTGModule) Stop() error {
+	_ = m.humidity.Halt()
+	if m.vcc != nil {
+		_ = m.vcc.Halt()
+	}
+	return m.temperature.Halt()
+}
+
+func (m *HTGModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &HTGModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	bus, err := sp.GetDefaultI2CBus()
+	if err != nil {
+		return fmt.Errorf("failed getting i2c device: %w", err)
+	}
+
+	ads, err := ads1x15.NewADS1115(bus, &ads1x15.DefaultOpts)
+	if err != nil {
+		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	}
+
+	temperature, err := config.pinForChannel(ads, config.TemperatureADCChannel)
+	if err != nil {
+		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	}
+	m.temperature = settle(temperature, config.DiscardConversions)
+	m.tk = htg3535ch.NewDefaultTemperatureK(m.temperature)
+
+	if config.VCCADCChannel != nil {
+		vcc, err := config.pinForChannel(ads, *config.VCCADCChannel)
+		if err != nil {
+			return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+		}
+		m.vcc = settle(vcc, config.DiscardConversions)
+		m.tk = htg3535ch.NewCalibrationTemperatureK(m.temperature, m.vcc)
+	}
+
+	humidity, err := config.pinForChannel(ads, config.HumidityADCChannel)
+	if err != nil {
+		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	}
+	m.humidity = settle(humidity, config.DiscardConversions)
+	m.rh = htg3535ch.NewHumidity(m.humidity)
+
+	m.config = *config
+	m.rhAdjustment = config.RHAdjustment
+
+	return nil
+}
+
+//SnapshotConfig reports the module's config with the current calibration.
+func (m *HTGModule) SnapshotConfig() interface{} {
+	config := m.config
+	config.RHAdjustment = m.getRHAdjustment()
+	return config
+}
+
+//ChangesConfig reports that "calibrate" changes the snapshot, so the new
+//adjustment is saved along with the module.
+func (*HTGModule) ChangesConfig(action string) bool { return action == "calibrate" }
+
+func (m *HTGModule) getRHAdjustment() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rhAdjustment
+}
+func (m *HTGModule) setRHAdjustment(adjustment float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rhAdjustment = adjustment
+}
+
+type HTGResistanceResponse struct {
+	ResistanceOhms float64 `json:"resistance_ohms"`
+	TemperatureK   float64 `json:"temperature_k"`
+}
+
+type HTGCalibrateRequest struct {
+	TrueValue    *float64 `json:"true_value"`
+	RHAdjustment *float64 `json:"rh_adjustment"`
+
+	// Samples is the number of RH reads averaged to compute the adjustment.
+	Samples int `json:"samples"`
+}
+
+//MaxCalibrationSamples bounds how long a calibrate can hold the module.
+const MaxCalibrationSamples = 100
+
+func (r *HTGCalibrateRequest) Default() {
+	r.Samples = 1
+}
+func (r HTGCalibrateRequest) Validate() error {
+	if r.Samples < 1 || r.Samples > MaxCalibrationSamples {
+		return fmt.Errorf("samples must be from 1 to %d", MaxCalibrationSamples)
+	}
+	return nil
+}
+
+type HTGCalibrateResponse struct {
+	RHAdjustment float64 `json:"rh_adjustment"`
+}
+
+func (m *HTGModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "rh":
+		val, err := m.rh.Read()
+		if err != nil {
+			return nil, err
+		}
+		val += m.getRHAdjustment()
+		return formatReading(body, val, physic.RelativeHumidity(val*float64(physic.PercentRH)))
+
+	// periph always formats temperatures in Celsius, so all three
+	// temperature actions share the same formatted string
+	case "tk":
+		val, err := m.tk.Read()
+		if err != nil {
+			return nil, err
+		}
+		return formatReading(body, val, kelvin(val))
+	case "tc":
+		val, err := m.tk.Read()
+		if err != nil {
+			return nil, err
+		}
+		return formatReading(body, val-273.15, kelvin(val))
+	case "tf":
+		val, err := m.tk.Read()
+		if err != nil {
+			return nil, err
+		}
+		return formatReading(body, (val-273.15)*9/5+32, kelvin(val))
+	case "resistance":
+		tk, ohms, err := m.tk.ReadWithResistance()
+		if err != nil {
+			return nil, err
+		}
+		return HTGResistanceResponse{
+			ResistanceOhms: ohms,
+			TemperatureK:   tk,
+		}, nil
+	case "calibrate":
+		var request = &HTGCalibrateRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		var adjustment float64
+		if request.RHAdjustment != nil {
+			adjustment = *request.RHAdjustment
+		} else {
+			var trueValue = 100.0
+			if request.TrueValue != nil {
+				trueValue = *request.TrueValue
+			}
+
+			val, err := averageReads(request.Samples, m.rh.Read)
+			if err != nil {
+				return nil, err
+			}
+			adjustment = trueValue - val
+		}
+
+		m.setRHAdjustment(adjustment)
+		return HTGCalibrateResponse{
+			RHAdjustment: adjustment,
+		}, nil
+	case "calibration":
+		return HTGCalibrateResponse{
+			RHAdjustment: m.getRHAdjustment(),
+		}, nil
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+func kelvin(val float64) physic.Temperature {
+	return physic.Temperature(val * float64(physic.Kelvin))
+}
+
+//averageReads takes n readings and returns their mean, failing on the
+//first read error.
+func averageReads(n int, read func() (float64, error)) (float64, error) {
+	var sum float64
+	for i := 0; i < n; i++ {
+		val, err := read()
+		if err != nil {
+			return 0, err
+		}
+		sum += val
+	}
+	return sum / float64(n), nil
+}
+
+type RGBLEDModule struct {
+	red, green, blue gpio.PinOut
+	commonAnode      bool
+	frequency        physic.Frequency
+
+	mu sync.Mutex
+}
+type RGBLEDModuleConfig struct {
+	RedPin      string `json:"red_pin"`
+	GreenPin    string `json:"green_pin"`
+	BluePin     string `json:"blue_pin"`
+	CommonAnode bool   `json:"common_anode"`
+	FrequencyHZ int    `json:"frequency_hz"`
+}
+
+func (c *RGBLEDModuleConfig) Default() {
+	c.FrequencyHZ = 1000
+}
+func (c RGBLEDModuleConfig) Validate() error {
+	if c.RedPin == "" || c.GreenPin == "" || c.BluePin == "" {
+		return errors.New("red_pin, green_pin and blue_pin are all required")
+	}
+	if c.FrequencyHZ <= 0 {
+		return errors.New("frequency_hz must be positive")
+	}
+	return nil
+}
+
+type RGBLEDSetRequest struct {
+	R int `json:"r"`
+	G int `json:"g"`
+	B int `json:"b"`
+}
+
+func (r RGBLEDSetRequest) Validate() error {
+	for _, c := range []int{r.R, r.G, r.B} {
+		if c < 0 || c > 255 {
+			return fmt.Errorf("color values must be between 0 and 255, got %d", c)
+		}
+	}
+	return nil
+}
+
+func (*RGBLEDModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: RGBLEDModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "set", Request: RGBLEDSetRequest{}},
+		},
+	}
+}
+
+func (*RGBLEDModule) Requires() []string { return []string{SubsystemGPIO} }
+
+func (m *RGBLEDModule) Pins() []string {
+	return []string{realPinName(m.red), realPinName(m.green), realPinName(m.blue)}
+}
+
+func (m *RGBLEDModule) Stop() error {
+	_ = m.red.Halt()
+	_ = m.green.Halt()
+	return m.blue.Halt()
+}
+
+func (m *RGBLEDModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &RGBLEDModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	pins := make([]gpio.PinOut, 3)
+	for i, name := range []string{config.RedPin, config.GreenPin, config.BluePin} {
+		pin, err := sp.GetGPIOByName(name)
+		if err != nil {
+			return err
+		}
+		if pin == nil {
+			return fmt.Errorf("Failed to find pin `%s`", name)
+		}
+		pins[i] = pin
+	}
+	m.red, m.green, m.blue = pins[0], pins[1], pins[2]
+	m.commonAnode = config.CommonAnode
+	m.frequency = physic.Frequency(config.FrequencyHZ) * physic.Hertz
+
+	return m.set(RGBLEDSetRequest{})
+}
+func (m *RGBLEDModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "set":
+		var request = &RGBLEDSetRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.set(*request)
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+func (m *RGBLEDModule) set(color RGBLEDSetRequest) error {
+	for _, c := range []struct {
+		pin   gpio.PinOut
+		value int
+	}{{m.red, color.R}, {m.green, color.G}, {m.blue, color.B}} {
+		if err := c.pin.PWM(rgbDuty(c.value, m.commonAnode), m.frequency); err != nil {
+			return fmt.Errorf("failed setting PWM on pin %s: %w", c.pin.Name(), err)
+		}
+	}
+	return nil
+}
+
+//rgbDuty converts an 8-bit color value into a duty cycle. A common-anode
+//LED lights up when its cathode is pulled low, so its duty is inverted.
+func rgbDuty(value int, commonAnode bool) gpio.Duty {
+	duty := gpio.Duty(int64(value) * int64(gpio.DutyMax) / 255)
+	if commonAnode {
+		return gpio.DutyMax - duty
+	}
+	return duty
+}
+
+type GPIOInputModule struct {
+	pin    gpio.PinIn
+	pull   gpio.Pull
+	logger *slog.Logger
+
+	// mu serializes reads with wait_edge, which reconfigures edge detection
+	// on the pin for the duration of the wait.
+	mu sync.Mutex
+}
+type GPIOInputModuleConfig struct {
+	Pin  string `json:"pin"`
+	Pull string `json:"pull"`
+}
+
+func (c *GPIOInputModuleConfig) Default() {
+	c.Pull = "none"
+}
+func (c GPIOInputModuleConfig) Validate() error {
+	if c.Pin == "" {
+		return errors.New("pin is required")
+	}
+	_, err := parsePull(c.Pull)
+	return err
+}
+
+func parsePull(pull string) (gpio.Pull, error) {
+	switch pull {
+	case "up":
+		return gpio.PullUp, nil
+	case "down":
+		return gpio.PullDown, nil
+	case "none":
+		return gpio.Float, nil
+	default:
+		return gpio.PullNoChange, fmt.Errorf("pull must be `up`, `down` or `none`, got `%s`", pull)
+	}
+}
+
+type GPIOInputReading struct {
+	High bool `json:"high"`
+}
+
+//MaxWaitEdgeTimeout bounds how long a wait_edge can hold the module.
+const MaxWaitEdgeTimeout = time.Minute
+
+type GPIOWaitEdgeRequest struct {
+	Edge      string `json:"edge"`
+	TimeoutMS int    `json:"timeout_ms"`
+}
+
+func (r *GPIOWaitEdgeRequest) Default() {
+	r.Edge = "both"
+	r.TimeoutMS = 1000
+}
+func (r GPIOWaitEdgeRequest) Validate() error {
+	if _, err := r.edge(); err != nil {
+		return err
+	}
+	if r.TimeoutMS <= 0 {
+		return errors.New("timeout_ms must be positive")
+	}
+	if r.timeout() > MaxWaitEdgeTimeout {
+		return fmt.Errorf("timeout_ms must be at most %d", MaxWaitEdgeTimeout.Milliseconds())
+	}
+	return nil
+}
+
+func (r GPIOWaitEdgeRequest) edge() (gpio.Edge, error) {
+	switch r.Edge {
+	case "rising":
+		return gpio.RisingEdge, nil
+	case "falling":
+		return gpio.FallingEdge, nil
+	case "both":
+		return gpio.BothEdges, nil
+	default:
+		return gpio.NoEdge, fmt.Errorf("edge must be `rising`, `falling` or `both`, got `%s`", r.Edge)
+	}
+}
+
+func (r GPIOWaitEdgeRequest) timeout() time.Duration {
+	return time.Duration(r.TimeoutMS) * time.Millisecond
+}
+
+type GPIOWaitEdgeResponse struct {
+	EdgeDetected bool `json:"edge_detected"`
+	High         bool `json:"high"`
+}
+
+func (*GPIOInputModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: GPIOInputModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "read"},
+			{Name: "wait_edge", Request: GPIOWaitEdgeRequest{}},
+		},
+	}
+}
+
+func (m *GPIOInputModule) SetLogger(logger *slog.Logger) { m.logger = logger }
+
+func (*GPIOInputModule) Requires() []string    { return []string{SubsystemGPIO} }
+func (*GPIOInputModule) DefaultAction() string { return "read" }
+func (m *GPIOInputModule) Pins() []string      { return []string{realPinName(m.pin)} }
+
+func (m *GPIOInputModule) Stop() error {
+	return m.pin.Halt()
+}
+
+func (m *GPIOInputModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &GPIOInputModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	pin, err := sp.GetGPIOByName(config.Pin)
+	if err != nil {
+		return err
+	}
+	if pin == nil {
+		return fmt.Errorf("Failed to find pin `%s`", config.Pin)
+	}
+
+	// validated above
+	m.pull, _ = parsePull(config.Pull)
+	if err := pin.In(m.pull, gpio.NoEdge); err != nil {
+		return fmt.Errorf("failed configuring pin %s as input: %w", config.Pin, err)
+	}
+	m.pin = pin
+
+	return nil
+}
+func (m *GPIOInputModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "read":
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return GPIOInputReading{High: bool(m.pin.Read())}, nil
+	case "wait_edge":
+		var request = &GPIOWaitEdgeRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.waitEdge(*request)
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+//waitEdge enables edge detection for the duration of one wait, so that
+//edges between waits aren't queued up and reported late. The caller must
+//hold m.mu.
+func (m *GPIOInputModule) waitEdge(request GPIOWaitEdgeRequest) (GPIOWaitEdgeResponse, error) {
+	// validated by BindData
+	edge, _ := request.edge()
+	if err := m.pin.In(m.pull, edge); err != nil {
+		return GPIOWaitEdgeResponse{}, fmt.Errorf("failed enabling edge detection: %w", err)
+	}
+	defer func() {
+		if err := m.pin.In(m.pull, gpio.NoEdge); err != nil {
+			m.logger.Error("failed disabling edge detection", "pin", m.pin.Name(), "error", err)
+		}
+	}()
+
+	detected := m.pin.WaitForEdge(request.timeout())
+	return GPIOWaitEdgeResponse{
+		EdgeDetected: detected,
+		High:         bool(m.pin.Read()),
+	}, nil
+}
+
+//stepperHalfSteps is the half-step coil sequence for a unipolar stepper
+//like the 28BYJ-48 driven through a ULN2003. Walking it forwards turns the
+//shaft clockwise.
+var stepperHalfSteps = [8][4]gpio.Level{
+	{gpio.High, gpio.Low, gpio.Low, gpio.Low},
+	{gpio.High, gpio.High, gpio.Low, gpio.Low},
+	{gpio.Low, gpio.High, gpio.Low, gpio.Low},
+	{gpio.Low, gpio.High, gpio.High, gpio.Low},
+	{gpio.Low, gpio.Low, gpio.High, gpio.Low},
+	{gpio.Low, gpio.Low, gpio.High, gpio.High},
+	{gpio.Low, gpio.Low, gpio.Low, gpio.High},
+	{gpio.High, gpio.Low, gpio.Low, gpio.High},
+}
+
+//MaxStepperMoveDuration bounds how long a single move can hold the module.
+const MaxStepperMoveDuration = time.Minute
+
+type StepperModule struct {
+	pins        [4]gpio.PinOut
+	stepsPerRev int
+	stepDelay   time.Duration
+	hold        bool
+
+	// phase is the index into stepperHalfSteps last applied, and position
+	// the net number of half-steps taken clockwise since Initialize.
+	mu       sync.Mutex
+	phase    int
+	position int
+}
+type StepperModuleConfig struct {
+	Pins        []string `json:"pins"`
+	StepsPerRev int      `json:"steps_per_rev"`
+	StepDelayMS int      `json:"step_delay_ms"`
+
+	// Hold keeps the coils energized between moves. This holds the shaft in
+	// place, at the cost of heating the motor.
+	Hold bool `json:"hold"`
+}
+
+func (c *StepperModuleConfig) Default() {
+	// half-steps per revolution of a 28BYJ-48's output shaft
+	c.StepsPerRev = 4096
+	c.StepDelayMS = 2
+}
+func (c StepperModuleConfig) Validate() error {
+	if len(c.Pins) != 4 {
+		return fmt.Errorf("exactly four pins are required, got %d", len(c.Pins))
+	}
+	if c.StepsPerRev <= 0 {
+		return errors.New("steps_per_rev must be positive")
+	}
+	if c.StepDelayMS <= 0 {
+		return errors.New("step_delay_ms must be positive")
+	}
+	return nil
+}
+
+type StepperStepRequest struct {
+	Steps     int    `json:"steps"`
+	Direction string `json:"direction"`
+}
+
+func (r *StepperStepRequest) Default() {
+	r.Direction = "cw"
+}
+func (r StepperStepRequest) Validate() error {
+	if r.Steps < 0 {
+		return errors.New("steps must not be negative")
+	}
+	if r.Direction != "cw" && r.Direction != "ccw" {
+		return fmt.Errorf("direction must be `cw` or `ccw`, got `%s`", r.Direction)
+	}
+	return nil
+}
+
+//StepperRotateRequest turns the shaft by Degrees, clockwise when positive.
+type StepperRotateRequest struct {
+	Degrees float64 `json:"degrees"`
+}
+
+type StepperMoveResponse struct {
+	Steps    int `json:"steps"`
+	Position int `json:"position"`
+}
+
+func (*StepperModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: StepperModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "step", Request: StepperStepRequest{}},
+			{Name: "rotate", Request: StepperRotateRequest{}},
+		},
+	}
+}
+
+func (*StepperModule) Requires() []string { return []string{SubsystemGPIO} }
+
+func (m *StepperModule) Pins() []string {
+	names := make([]string, len(m.pins))
+	for i, pin := range m.pins {
+		names[i] = realPinName(pin)
+	}
+	return names
+}
+
+func (m *StepperModule) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.release()
+	for _, pin := range m.pins {
+		_ = pin.Halt()
+	}
+	return err
+}
+
+func (m *StepperModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &StepperModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	for i, name := range config.Pins {
+		pin, err := sp.GetGPIOByName(name)
+		if err != nil {
+			return err
+		}
+		if pin == nil {
+			return fmt.Errorf("Failed to find pin `%s`", name)
+		}
+		m.pins[i] = pin
+	}
+	m.stepsPerRev = config.StepsPerRev
+	m.stepDelay = time.Duration(config.StepDelayMS) * time.Millisecond
+	m.hold = config.Hold
+
+	return m.release()
+}
+func (m *StepperModule) Act(action string, body Binder) (interface{}, error) {
+	var steps int
+	switch action {
+	case "step":
+		var request = &StepperStepRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+		steps = request.Steps
+		if request.Direction == "ccw" {
+			steps = -steps
+		}
+	case "rotate":
+		var request = &StepperRotateRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+		steps = int(math.Round(request.Degrees / 360 * float64(m.stepsPerRev)))
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.move(steps)
+}
+
+//move takes steps half-steps, clockwise when positive. The caller must
+//hold m.mu.
+func (m *StepperModule) move(steps int) (StepperMoveResponse, error) {
+	n, dir := steps, 1
+	if n < 0 {
+		n, dir = -n, -1
+	}
+	if d := time.Duration(n) * m.stepDelay; d > MaxStepperMoveDuration {
+		return StepperMoveResponse{}, InputError{error: fmt.Errorf("moving %d steps would take %v, exceeding the limit of %v", n, d, MaxStepperMoveDuration)}
+	}
+
+	for i := 0; i < n; i++ {
+		phase := (m.phase + dir + len(stepperHalfSteps)) % len(stepperHalfSteps)
+		if err := m.energize(stepperHalfSteps[phase]); err != nil {
+			return StepperMoveResponse{Steps: i * dir, Position: m.position}, err
+		}
+		m.phase = phase
+		m.position += dir
+		time.Sleep(m.stepDelay)
+	}
+
+	if !m.hold {
+		if err := m.release(); err != nil {
+			return StepperMoveResponse{Steps: steps, Position: m.position}, err
+		}
+	}
+	return StepperMoveResponse{Steps: steps, Position: m.position}, nil
+}
+
+func (m *StepperModule) energize(levels [4]gpio.Level) error {
+	for i, pin := range m.pins {
+		if err := pin.Out(levels[i]); err != nil {
+			return fmt.Errorf("failed driving pin %s: %w", pin.Name(), err)
+		}
+	}
+	return nil
+}
+
+//release de-energizes every coil.
+func (m *StepperModule) release() error {
+	return m.energize([4]gpio.Level{})
+}
+
+//PCA9685 registers and MODE1 bits, from the datasheet.
+const (
+	pca9685Mode1     = 0x00
+	pca9685LED0On    = 0x06
+	pca9685AllLEDOn  = 0xFA
+	pca9685Prescale  = 0xFE
+	pca9685Sleep     = 0x10
+	pca9685AutoIncr  = 0x20
+	pca9685Restart   = 0x80
+	pca9685FullOnOff = 0x10
+
+	pca9685OscillatorHZ = 25000000
+	pca9685Steps        = 4096
+	pca9685Channels     = 16
+
+	MinPCA9685FrequencyHZ = 24
+	MaxPCA9685FrequencyHZ = 1526
+)
+
+type PCA9685Module struct {
+	dvc       I2CDevice
+	addr      uint16
+	frequency float64
+
+	mu sync.Mutex
+}
+type PCA9685ModuleConfig struct {
+	Address     uint16  `json:"address"`
+	FrequencyHZ float64 `json:"frequency_hz"`
+}
+
+func (c *PCA9685ModuleConfig) Default() {
+	c.Address = 0x40
+	// the usual frequency for hobby servos
+	c.FrequencyHZ = 50
+}
+func (c PCA9685ModuleConfig) Validate() error {
+	if err := validateI2CAddress(c.Address); err != nil {
+		return err
+	}
+	if c.FrequencyHZ < MinPCA9685FrequencyHZ || c.FrequencyHZ > MaxPCA9685FrequencyHZ {
+		return fmt.Errorf("frequency_hz must be between %d and %d", MinPCA9685FrequencyHZ, MaxPCA9685FrequencyHZ)
+	}
+	return nil
+}
+
+type PCA9685SetChannelRequest struct {
+	Channel   int     `json:"channel"`
+	DutyRatio float64 `json:"duty_ratio"`
+}
+
+func (r PCA9685SetChannelRequest) Validate() error {
+	if err := validatePCA9685Channel(r.Channel); err != nil {
+		return err
+	}
+	if r.DutyRatio < 0 || r.DutyRatio > 1 {
+		return fmt.Errorf("duty_ratio must be between 0 and 1, got %v", r.DutyRatio)
+	}
+	return nil
+}
+
+//PCA9685ServoRequest positions a servo by mapping Angle linearly onto a
+//pulse between MinPulseUS and MaxPulseUS.
+type PCA9685ServoRequest struct {
+	Channel    int     `json:"channel"`
+	Angle      float64 `json:"angle"`
+	MinPulseUS float64 `json:"min_pulse_us"`
+	MaxPulseUS float64 `json:"max_pulse_us"`
+	MaxAngle   float64 `json:"max_angle"`
+}
+
+func (r *PCA9685ServoRequest) Default() {
+	r.MinPulseUS = 1000
+	r.MaxPulseUS = 2000
+	r.MaxAngle = 180
+}
+func (r PCA9685ServoRequest) Validate() error {
+	if err := validatePCA9685Channel(r.Channel); err != nil {
+		return err
+	}
+	if r.MinPulseUS <= 0 || r.MaxPulseUS <= r.MinPulseUS {
+		return errors.New("min_pulse_us must be positive and less than max_pulse_us")
+	}
+	if r.MaxAngle <= 0 {
+		return errors.New("max_angle must be positive")
+	}
+	if r.Angle < 0 || r.Angle > r.MaxAngle {
+		return fmt.Errorf("angle must be between 0 and %v, got %v", r.MaxAngle, r.Angle)
+	}
+	return nil
 }
 
-type RelayModule struct {
-	pin gpio.PinOut
-}
-type RelayModuleConfig struct {
-	Pin string `json:"pin"`
+func (r PCA9685ServoRequest) pulseUS() float64 {
+	return r.MinPulseUS + r.Angle/r.MaxAngle*(r.MaxPulseUS-r.MinPulseUS)
 }
-type RelaySetRequest struct {
-	High bool `json:"high"`
+
+func validatePCA9685Channel(ch int) error {
+	if ch < 0 || ch >= pca9685Channels {
+		return fmt.Errorf("channel must be between 0 and %d, got %d", pca9685Channels-1, ch)
+	}
+	return nil
 }
 
-func (r RelaySetRequest) Level() gpio.Level {
-	return gpio.Level(r.High)
+func (*PCA9685Module) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: PCA9685ModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "set_channel", Request: PCA9685SetChannelRequest{}},
+			{Name: "set_servo_angle", Request: PCA9685ServoRequest{}},
+		},
+	}
 }
 
-func (*RelayModule) Stop() error { return nil }
+func (*PCA9685Module) Requires() []string { return []string{SubsystemI2C} }
+func (m *PCA9685Module) Pins() []string   { return []string{fmt.Sprintf("I2C(%#x)", m.addr)} }
 
-func (m *RelayModule) Initialize(sp ServiceProvider, binder Binder) error {
-	var config = &RelayModuleConfig{}
+//Stop turns every channel fully off.
+func (m *PCA9685Module) Stop() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.dvc.Tx([]byte{pca9685AllLEDOn, 0, 0, 0, pca9685FullOnOff}, nil)
+}
+
+func (m *PCA9685Module) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &PCA9685ModuleConfig{}
 	if err := binder.BindData(config); err != nil {
 		return err
 	}
 
-	// Use gpioreg GPIO pin registry to find a GPIO pin by name.
-	pin := gpioreg.ByName(config.Pin)
-	if pin == nil {
-		return errors.New("Failed to find pin")
-	}
-	if err := pin.Out(gpio.Low); err != nil {
-		return err
+	bus, err := sp.GetDefaultI2CBus()
+	if err != nil {
+		return fmt.Errorf("failed getting i2c device: %w", err)
 	}
-	m.pin = pin
+	m.dvc = &i2c.Dev{Bus: bus, Addr: config.Address}
+	m.addr = config.Address
+	m.frequency = config.FrequencyHZ
 
+	if err := m.setFrequency(); err != nil {
+		return fmt.Errorf("failed initializing PCA9685 device: %w", err)
+	}
 	return nil
 }
-func (m *RelayModule) Act(action string, body Binder) (interface{}, error) {
-	var request = &RelaySetRequest{}
-	if err := body.BindData(request); err != nil {
-		return nil, err
+func (m *PCA9685Module) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "set_channel":
+		var request = &PCA9685SetChannelRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.setDuty(request.Channel, request.DutyRatio)
+	case "set_servo_angle":
+		var request = &PCA9685ServoRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.setDuty(request.Channel, request.pulseUS()*m.frequency/1e6)
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
 	}
+}
 
-	switch action {
-	case "set":
-		return nil, m.pin.Out(request.Level())
+//setFrequency programs the prescaler, which can only be written while the
+//oscillator is asleep, then wakes the chip with register auto-increment on.
+func (m *PCA9685Module) setFrequency() error {
+	for _, w := range [][]byte{
+		{pca9685Mode1, pca9685Sleep},
+		{pca9685Prescale, pca9685PrescaleFor(m.frequency)},
+		{pca9685Mode1, pca9685AutoIncr},
+	} {
+		if err := m.dvc.Tx(w, nil); err != nil {
+			return err
+		}
+	}
+
+	// the oscillator needs 500us to stabilize before PWM restarts
+	time.Sleep(500 * time.Microsecond)
+	return m.dvc.Tx([]byte{pca9685Mode1, pca9685AutoIncr | pca9685Restart}, nil)
+}
+
+func pca9685PrescaleFor(frequency float64) byte {
+	return byte(math.Round(pca9685OscillatorHZ/(pca9685Steps*frequency)) - 1)
+}
+
+//setDuty writes a channel's on and off counts. The extremes use the
+//channel's full-on and full-off bits, since a count can't span the whole
+//period. The caller must hold m.mu.
+func (m *PCA9685Module) setDuty(ch int, ratio float64) error {
+	var on, off uint16
+	switch count := uint16(math.Round(ratio * pca9685Steps)); {
+	case count == 0:
+		off = pca9685FullOnOff << 8
+	case count >= pca9685Steps:
+		on = pca9685FullOnOff << 8
 	default:
-		return nil, fmt.Errorf("no such action `%s`", action)
+		off = count
 	}
+
+	return m.dvc.Tx([]byte{
+		byte(pca9685LED0On + 4*ch),
+		byte(on), byte(on >> 8),
+		byte(off), byte(off >> 8),
+	}, nil)
 }
 
-type I2CModule struct {
-	dvc I2CDevice
+type BME280Module struct {
+	dev  *bmxx80.Dev
+	addr uint16
+
+	// hasHumidity is false for the BMP280, which shares the BME280's
+	// registers but has no humidity sensor.
+	hasHumidity bool
+
+	mu sync.Mutex
 }
-type I2CModuleConfig struct {
+type BME280ModuleConfig struct {
 	Address uint16 `json:"address"`
 }
-type I2CTransactRequest struct {
-	Bytes          []byte `json:"bytes"`
-	ResponseLength int    `json:"resp_len"`
+
+func (c *BME280ModuleConfig) Default() {
+	c.Address = 0x76
+}
+func (c BME280ModuleConfig) Validate() error {
+	return validateI2CAddress(c.Address)
 }
 
-func (*I2CModule) Stop() error { return nil }
+type BME280Reading struct {
+	TemperatureC float64  `json:"temperature_c"`
+	PressurePa   float64  `json:"pressure_pa"`
+	RH           *float64 `json:"rh,omitempty"`
+}
 
-func (m *I2CModule) Initialize(sp ServiceProvider, binder Binder) error {
-	var config = &I2CModuleConfig{}
+func (*BME280Module) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: BME280ModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "read"},
+			{Name: "temp_c", Request: FormatRequest{}},
+			{Name: "pressure_pa", Request: FormatRequest{}},
+			{Name: "rh", Request: FormatRequest{}},
+		},
+	}
+}
+
+func (*BME280Module) Requires() []string    { return []string{SubsystemI2C} }
+func (*BME280Module) DefaultAction() string { return "read" }
+func (m *BME280Module) Pins() []string      { return []string{fmt.Sprintf("I2C(%#x)", m.addr)} }
+
+func (m *BME280Module) Stop() error {
+	return m.dev.Halt()
+}
+
+func (m *BME280Module) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &BME280ModuleConfig{}
 	if err := binder.BindData(config); err != nil {
 		return err
 	}
 
-	var err error
 	bus, err := sp.GetDefaultI2CBus()
-	m.dvc = &i2c.Dev{Bus: bus, Addr: config.Address}
 	if err != nil {
 		return fmt.Errorf("failed getting i2c device: %w", err)
 	}
 
+	// this fails on an unexpected chip id, which usually means some other
+	// device is at the address
+	m.dev, err = bmxx80.NewI2C(bus, config.Address, &bmxx80.DefaultOpts)
+	if err != nil {
+		return fmt.Errorf("failed initializing BMP280/BME280 device at %#x: %w", config.Address, err)
+	}
+	if !strings.HasPrefix(m.dev.String(), "BME280") && !strings.HasPrefix(m.dev.String(), "BMP280") {
+		_ = m.dev.Halt()
+		return fmt.Errorf("device at %#x is a %s, not a BMP280/BME280", config.Address, m.dev)
+	}
+	m.hasHumidity = strings.HasPrefix(m.dev.String(), "BME280")
+	m.addr = config.Address
+
 	return nil
 }
-func (m *I2CModule) Act(action string, body Binder) (interface{}, error) {
-	var request = &I2CTransactRequest{}
-	if err := body.BindData(request); err != nil {
-		return nil, err
+func (m *BME280Module) Act(action string, body Binder) (interface{}, error) {
+	if action == "rh" && !m.hasHumidity {
+		return nil, NotFoundError{error: errors.New("the BMP280 has no humidity sensor")}
 	}
 
+	var env physic.Env
 	switch action {
-	case "transact":
-		resp := make([]byte, request.ResponseLength)
-		if err := m.dvc.Tx(request.Bytes, resp); err != nil {
-			return nil, fmt.Errorf("failed executing I2C transaction: %w", err)
+	case "read", "temp_c", "pressure_pa", "rh":
+		m.mu.Lock()
+		err := m.dev.Sense(&env)
+		m.mu.Unlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading BMP280/BME280: %w", err)
 		}
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
 
-		return map[string]interface{}{
-			"response": resp,
-		}, nil
-
+	reading := m.reading(env)
+	switch action {
+	case "temp_c":
+		return formatReading(body, reading.TemperatureC, env.Temperature)
+	case "pressure_pa":
+		return formatReading(body, reading.PressurePa, env.Pressure)
+	case "rh":
+		return formatReading(body, *reading.RH, env.Humidity)
 	default:
-		return nil, fmt.Errorf("no such action `%s`", action)
+		return reading, nil
 	}
 }
 
-type ADS1115Module struct {
-	ads *ads1x15.Dev
-	pin analog.PinADC
+func (m *BME280Module) reading(env physic.Env) BME280Reading {
+	reading := BME280Reading{
+		TemperatureC: float64(env.Temperature-physic.ZeroCelsius) / float64(physic.Celsius),
+		PressurePa:   float64(env.Pressure) / float64(physic.Pascal),
+	}
+	if m.hasHumidity {
+		rh := float64(env.Humidity) / float64(physic.PercentRH)
+		reading.RH = &rh
+	}
+	return reading
 }
-type ADS1115ModuleConfig struct {
-	Ch int `json:"channel_mask"`
+
+//PIRModule reads a PIR motion sensor, whose output is held high while it
+//sees motion. It's a GPIOInputModule that only cares about rising edges.
+type PIRModule struct {
+	input GPIOInputModule
+}
+type PIRModuleConfig struct {
+	Pin  string `json:"pin"`
+	Pull string `json:"pull"`
 }
 
-func (m *ADS1115Module) Stop() error {
-	return m.pin.Halt()
+func (c *PIRModuleConfig) Default() {
+	// keeps a disconnected sensor from reporting phantom motion
+	c.Pull = "down"
+}
+func (c PIRModuleConfig) Validate() error {
+	return GPIOInputModuleConfig(c).Validate()
 }
 
-func (m *ADS1115Module) Initialize(sp ServiceProvider, binder Binder) error {
-	var config = &ADS1115ModuleConfig{}
+type PIRWaitMotionRequest struct {
+	TimeoutMS int `json:"timeout_ms"`
+}
+
+func (r *PIRWaitMotionRequest) Default() {
+	r.TimeoutMS = 1000
+}
+func (r PIRWaitMotionRequest) Validate() error {
+	return r.edgeRequest().Validate()
+}
+
+func (r PIRWaitMotionRequest) edgeRequest() GPIOWaitEdgeRequest {
+	return GPIOWaitEdgeRequest{Edge: "rising", TimeoutMS: r.TimeoutMS}
+}
+
+type PIRMotionResponse struct {
+	Motion bool `json:"motion"`
+}
+
+func (*PIRModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: PIRModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "read"},
+			{Name: "wait_motion", Request: PIRWaitMotionRequest{}},
+		},
+	}
+}
+
+func (m *PIRModule) SetLogger(logger *slog.Logger) { m.input.SetLogger(logger) }
+
+func (*PIRModule) Requires() []string    { return []string{SubsystemGPIO} }
+func (*PIRModule) DefaultAction() string { return "read" }
+func (m *PIRModule) Pins() []string      { return m.input.Pins() }
+
+func (m *PIRModule) Stop() error {
+	return m.input.Stop()
+}
+
+func (m *PIRModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &PIRModuleConfig{}
 	if err := binder.BindData(config); err != nil {
 		return err
 	}
 
-	bus, err := sp.GetDefaultI2CBus()
+	pin, err := sp.GetGPIOByName(config.Pin)
 	if err != nil {
-		return fmt.Errorf("failed getting i2c device: %w", err)
+		return err
 	}
-
-	m.ads, err = ads1x15.NewADS1115(bus, &ads1x15.DefaultOpts)
-	if err != nil {
-		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	if pin == nil {
+		return fmt.Errorf("Failed to find pin `%s`", config.Pin)
 	}
 
-	m.pin, err = m.ads.PinForChannel(ads1x15.Channel(config.Ch),
-		5*physic.Volt, 1*physic.Hertz, ads1x15.SaveEnergy)
-	if err != nil {
-		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	// validated above
+	pull, _ := parsePull(config.Pull)
+	if err := pin.In(pull, gpio.NoEdge); err != nil {
+		return fmt.Errorf("failed configuring pin %s as input: %w", config.Pin, err)
 	}
+	m.input.pin = pin
+	m.input.pull = pull
 
 	return nil
 }
-func (m *ADS1115Module) Act(action string, _ Binder) (interface{}, error) {
+func (m *PIRModule) Act(action string, body Binder) (interface{}, error) {
 	switch action {
 	case "read":
-		sample, err := m.pin.Read()
-		return float64(sample.V) / float64(physic.Volt), err
+		m.input.mu.Lock()
+		defer m.input.mu.Unlock()
+		return PIRMotionResponse{Motion: bool(m.input.pin.Read())}, nil
+	case "wait_motion":
+		var request = &PIRWaitMotionRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		m.input.mu.Lock()
+		defer m.input.mu.Unlock()
+
+		// motion that's already underway counts, with no edge to wait for
+		if m.input.pin.Read() == gpio.High {
+			return PIRMotionResponse{Motion: true}, nil
+		}
+		resp, err := m.input.waitEdge(request.edgeRequest())
+		if err != nil {
+			return nil, err
+		}
+		return PIRMotionResponse{Motion: resp.EdgeDetected}, nil
 	default:
-		return nil, fmt.Errorf("no such action `%s`", action)
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
 	}
 }
 
-type HTGModule struct {
-	humidity    analog.PinADC
-	temperature analog.PinADC
+type SPIModule struct {
+	port spi.PortCloser
+	conn spi.Conn
 
-	tk htg3535ch.TemperatureK
-	rh htg3535ch.Humidity
+	mu sync.Mutex
+}
+type SPIModuleConfig struct {
+	// Port names an SPI port like "SPI0.0". The default port is used when
+	// it's empty.
+	Port    string `json:"port"`
+	SpeedHZ int64  `json:"speed_hz"`
+	Mode    int    `json:"mode"`
+	Bits    int    `json:"bits"`
+}
 
-	rhAdjustment float64
+func (c *SPIModuleConfig) Default() {
+	c.SpeedHZ = 1000000
+	c.Bits = 8
 }
-type HTGModuleConfig struct {
-	TemperatureADCChannel int     `json:"temperature_adc_channel"`
-	HumidityADCChannel    int     `json:"humidity_adc_channel"`
-	RHAdjustment          float64 `json:"rh_adjustment"`
+func (c SPIModuleConfig) Validate() error {
+	if c.SpeedHZ <= 0 {
+		return errors.New("speed_hz must be positive")
+	}
+	if c.Mode < 0 || c.Mode > 3 {
+		return fmt.Errorf("mode must be between 0 and 3, got %d", c.Mode)
+	}
+	if c.Bits <= 0 {
+		return errors.New("bits must be positive")
+	}
+	return nil
 }
 
-func (m *HTGModule) Stop() error {
-	_ = m.humidity.Halt()
-	return m.temperature.Halt()
+//SPITransactRequest is a full-duplex transaction. SPI reads one byte for
+//every byte written, so Bytes is padded with zeroes to ResponseLength when
+//more is to be read than written.
+type SPITransactRequest struct {
+	Bytes          Bytes `json:"bytes"`
+	ResponseLength int   `json:"resp_len"`
 }
 
-func (m *HTGModule) Initialize(sp ServiceProvider, binder Binder) error {
-	var config = &HTGModuleConfig{}
+func (r SPITransactRequest) Validate() error {
+	if r.ResponseLength < 0 {
+		return errors.New("resp_len must not be negative")
+	}
+	return nil
+}
+
+func (*SPIModule) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: SPIModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "transact", Request: SPITransactRequest{}},
+		},
+	}
+}
+
+func (*SPIModule) Requires() []string { return []string{SubsystemSPI} }
+func (m *SPIModule) Pins() []string   { return []string{fmt.Sprintf("SPI(%s)", m.port)} }
+
+func (m *SPIModule) Stop() error {
+	return m.port.Close()
+}
+
+func (m *SPIModule) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &SPIModuleConfig{}
 	if err := binder.BindData(config); err != nil {
 		return err
 	}
 
-	bus, err := sp.GetDefaultI2CBus()
+	port, err := sp.GetSPIPortByName(config.Port)
 	if err != nil {
-		return fmt.Errorf("failed getting i2c device: %w", err)
+		return fmt.Errorf("failed opening spi port: %w", err)
 	}
 
-	ads, err := ads1x15.NewADS1115(bus, &ads1x15.DefaultOpts)
+	conn, err := port.Connect(physic.Frequency(config.SpeedHZ)*physic.Hertz, spi.Mode(config.Mode), config.Bits)
 	if err != nil {
-		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+		_ = port.Close()
+		return fmt.Errorf("failed connecting to spi port %s: %w", port, err)
 	}
+	m.port = port
+	m.conn = conn
 
-	m.temperature, err = ads.PinForChannel(
-		ads1x15.Channel(config.TemperatureADCChannel),
-		5*physic.Volt, 1*physic.Hertz, ads1x15.BestQuality)
-	if err != nil {
-		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+	return nil
+}
+func (m *SPIModule) Act(action string, body Binder) (interface{}, error) {
+	switch action {
+	case "transact":
+		var request = &SPITransactRequest{}
+		if err := body.BindData(request); err != nil {
+			return nil, err
+		}
+
+		n := len(request.Bytes)
+		if request.ResponseLength > n {
+			n = request.ResponseLength
+		}
+		w := make([]byte, n)
+		copy(w, request.Bytes)
+		resp := make([]byte, n)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if err := m.conn.Tx(w, resp); err != nil {
+			return nil, fmt.Errorf("failed executing SPI transaction: %w", err)
+		}
+
+		return map[string]interface{}{
+			"response": resp,
+		}, nil
+	default:
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
 	}
-	m.tk = htg3535ch.NewDefaultTemperatureK(m.temperature)
+}
 
-	m.humidity, err = ads.PinForChannel(
-		ads1x15.Channel(config.HumidityADCChannel),
-		5*physic.Volt, 1*physic.Hertz, ads1x15.BestQuality)
-	if err != nil {
-		return fmt.Errorf("failed initializing ADS1115 device: %w", err)
+//MCP3008Module reads the 10-bit, 8-channel MCP3008 ADC over SPI.
+type MCP3008Module struct {
+	spi  SPIModule
+	vref float64
+}
+type MCP3008ModuleConfig struct {
+	Port      string  `json:"port"`
+	VrefVolts float64 `json:"vref_volts"`
+	SpeedHZ   int64   `json:"speed_hz"`
+}
+
+func (c *MCP3008ModuleConfig) Default() {
+	c.VrefVolts = 3.3
+	// the datasheet's limit at 2.7V is 1.35MHz
+	c.SpeedHZ = 1000000
+}
+func (c MCP3008ModuleConfig) Validate() error {
+	if c.VrefVolts <= 0 {
+		return errors.New("vref_volts must be positive")
 	}
-	m.rh = htg3535ch.NewHumidity(m.humidity)
+	if c.SpeedHZ <= 0 {
+		return errors.New("speed_hz must be positive")
+	}
+	return nil
+}
 
-	m.rhAdjustment = config.RHAdjustment
+type MCP3008ReadRequest struct {
+	Channel int `json:"channel"`
+}
 
+func (r MCP3008ReadRequest) Validate() error {
+	if r.Channel < 0 || r.Channel > 7 {
+		return fmt.Errorf("channel must be between 0 and 7, got %d", r.Channel)
+	}
 	return nil
 }
 
-type HTGCalibrateRequest struct {
-	TrueValue    *float64 `json:"true_value"`
-	RHAdjustment *float64 `json:"rh_adjustment"`
+type MCP3008Reading struct {
+	Channel int     `json:"channel"`
+	Raw     int     `json:"raw"`
+	Volts   float64 `json:"volts"`
 }
-type HTGCalibrateResponse struct {
-	RHAdjustment float64 `json:"rh_adjustment"`
+
+func (*MCP3008Module) Describe() ModuleDescriptor {
+	return ModuleDescriptor{
+		Config: MCP3008ModuleConfig{},
+		Actions: []ActionDescriptor{
+			{Name: "read", Request: MCP3008ReadRequest{}},
+		},
+	}
 }
 
-func (m *HTGModule) Act(action string, body Binder) (interface{}, error) {
+func (*MCP3008Module) Requires() []string    { return []string{SubsystemSPI} }
+func (*MCP3008Module) DefaultAction() string { return "read" }
+func (m *MCP3008Module) Pins() []string      { return m.spi.Pins() }
+
+func (m *MCP3008Module) Stop() error {
+	return m.spi.Stop()
+}
+
+func (m *MCP3008Module) Initialize(sp ServiceProvider, binder Binder) error {
+	var config = &MCP3008ModuleConfig{}
+	if err := binder.BindData(config); err != nil {
+		return err
+	}
+
+	port, err := sp.GetSPIPortByName(config.Port)
+	if err != nil {
+		return fmt.Errorf("failed opening spi port: %w", err)
+	}
+
+	conn, err := port.Connect(physic.Frequency(config.SpeedHZ)*physic.Hertz, spi.Mode0, 8)
+	if err != nil {
+		_ = port.Close()
+		return fmt.Errorf("failed connecting to spi port %s: %w", port, err)
+	}
+	m.spi.port = port
+	m.spi.conn = conn
+	m.vref = config.VrefVolts
+
+	return nil
+}
+func (m *MCP3008Module) Act(action string, body Binder) (interface{}, error) {
 	switch action {
-	case "rh":
-		val, err := m.rh.Read()
-		return val + m.rhAdjustment, err
-	case "tk":
-		val, err := m.tk.Read()
-		return val, err
-	case "tc":
-		val, err := m.tk.Read()
-		return val - 273.15, err
-	case "tf":
-		val, err := m.tk.Read()
-		return (val-273.15)*9/5 + 32, err
-	case "calibrate":
-		var request = &HTGCalibrateRequest{}
+	case "read":
+		var request = &MCP3008ReadRequest{}
 		if err := body.BindData(request); err != nil {
 			return nil, err
 		}
 
-		var adjustment float64
-		if request.RHAdjustment != nil {
-			adjustment = *request.RHAdjustment
-		} else {
-			var trueValue = 100.0
-			if request.TrueValue != nil {
-				trueValue = *request.TrueValue
-			}
-
-			val, err := m.rh.Read()
-			if err != nil {
-				return nil, err
-			}
-			adjustment = trueValue - val
-		}
-
-		m.rhAdjustment = adjustment
-		return HTGCalibrateResponse{
-			RHAdjustment: adjustment,
-		}, nil
+		m.spi.mu.Lock()
+		defer m.spi.mu.Unlock()
+		return m.read(request.Channel)
 	default:
-		return nil, fmt.Errorf("no such action `%s`", action)
+		return nil, NotFoundError{error: fmt.Errorf("no such action `%s`", action)}
+	}
+}
+
+//read performs a single-ended conversion: a start bit, then the
+//single-ended flag and channel number, after which the chip clocks out the
+//10-bit result. The caller must hold m.spi.mu.
+func (m *MCP3008Module) read(ch int) (MCP3008Reading, error) {
+	w := []byte{0x01, byte(0x08|ch) << 4, 0x00}
+	r := make([]byte, len(w))
+	if err := m.spi.conn.Tx(w, r); err != nil {
+		return MCP3008Reading{}, fmt.Errorf("failed reading MCP3008: %w", err)
 	}
+
+	raw := int(r[1]&0x03)<<8 | int(r[2])
+	return MCP3008Reading{
+		Channel: ch,
+		Raw:     raw,
+		Volts:   float64(raw) * m.vref / 1024,
+	}, nil
 }
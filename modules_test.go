@@ -0,0 +1,1469 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"periph.io/x/periph/conn/conntest"
+	"periph.io/x/periph/conn/gpio"
+	"periph.io/x/periph/conn/gpio/gpiotest"
+	"periph.io/x/periph/conn/i2c"
+	"periph.io/x/periph/conn/i2c/i2ctest"
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/conn/spi/spitest"
+	"periph.io/x/periph/experimental/conn/analog"
+	"periph.io/x/periph/experimental/devices/ads1x15"
+
+	"github.com/xanderflood/pihub/pkg/htg3535ch"
+)
+
+func TestHTGCalibrateRequest(t *testing.T) {
+	for _, tc := range []struct {
+		body        string
+		wantErr     bool
+		wantSamples int
+	}{
+		{body: `{}`, wantSamples: 1},
+		{body: `{"samples": 10}`, wantSamples: 10},
+		{body: `{"samples": 100}`, wantSamples: MaxCalibrationSamples},
+		{body: `{"samples": 0}`, wantErr: true},
+		{body: `{"samples": 101}`, wantErr: true},
+		{body: `{"samples": 1000000}`, wantErr: true},
+	} {
+		var request HTGCalibrateRequest
+		err := bind(tc.body, &request)
+
+		var iErr InputError
+		if tc.wantErr != errors.As(err, &iErr) {
+			t.Errorf("%s: got error %v, want an InputError: %v", tc.body, err, tc.wantErr)
+		}
+		if !tc.wantErr && request.Samples != tc.wantSamples {
+			t.Errorf("%s: got %d samples, want %d", tc.body, request.Samples, tc.wantSamples)
+		}
+	}
+}
+
+// fakeADC is an analog pin whose voltage tests can set. Reads return queue
+// in order before falling back to v.
+type fakeADC struct {
+	mu    sync.Mutex
+	v     physic.ElectricPotential
+	queue []physic.ElectricPotential
+	reads int
+}
+
+func (*fakeADC) String() string   { return "FAKE_ADC" }
+func (*fakeADC) Name() string     { return "FAKE_ADC" }
+func (*fakeADC) Number() int      { return -1 }
+func (*fakeADC) Function() string { return "ADC" }
+func (*fakeADC) Halt() error      { return nil }
+func (*fakeADC) Range() (analog.Sample, analog.Sample) {
+	return analog.Sample{}, analog.Sample{V: 4 * physic.Volt}
+}
+func (p *fakeADC) Read() (analog.Sample, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reads++
+	if len(p.queue) > 0 {
+		v := p.queue[0]
+		p.queue = p.queue[1:]
+		return analog.Sample{V: v}, nil
+	}
+	return analog.Sample{V: p.v}, nil
+}
+func (p *fakeADC) set(v physic.ElectricPotential) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.v = v
+}
+func (p *fakeADC) numReads() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reads
+}
+
+func TestADS1115ReadShapeMatchesAcrossModes(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want interface{}
+	}{
+		{"bare value", `{}`, 1.5},
+		{"timestamp", `{"timestamp": true}`, ADS1115Reading{}},
+		{"full scale", `{"full_scale": true}`, ADS1115Reading{}},
+	} {
+		for _, continuous := range []bool{false, true} {
+			pin := &fakeADC{v: 1500 * physic.MilliVolt}
+			m := &ADS1115Module{pin: pin}
+			if continuous {
+				m.sampler = startADCSampler(pin, time.Millisecond)
+			}
+
+			for _, action := range []string{"read", "read_fresh"} {
+				result, err := m.Act(action, (&ManagerAgent{}).Binder([]byte(tc.body)))
+				if err != nil {
+					t.Fatalf("%s %s (continuous: %v): %v", tc.name, action, continuous, err)
+				}
+				if reflect.TypeOf(result) != reflect.TypeOf(tc.want) {
+					t.Errorf("%s %s (continuous: %v): got a %T, want a %T", tc.name, action, continuous, result, tc.want)
+				}
+				if reading, ok := result.(ADS1115Reading); ok && reading.Value != 1.5 {
+					t.Errorf("%s %s (continuous: %v): got value %v, want 1.5", tc.name, action, continuous, reading.Value)
+				}
+			}
+			if err := m.Stop(); err != nil {
+				t.Fatalf("stop failed: %v", err)
+			}
+		}
+	}
+}
+
+func TestADS1115ContinuousSampler(t *testing.T) {
+	pin := &fakeADC{v: physic.Volt}
+	m := &ADS1115Module{pin: pin, sampler: startADCSampler(pin, time.Millisecond)}
+	read := func() interface{} {
+		result, err := m.Act("read", (&ManagerAgent{}).Binder(nil))
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		return result
+	}
+
+	pin.set(2 * physic.Volt)
+	deadline := time.Now().Add(time.Second)
+	for read() != 2.0 {
+		if time.Now().After(deadline) {
+			t.Fatal("cached value never updated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := m.Stop(); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	reads := pin.numReads()
+	time.Sleep(20 * time.Millisecond)
+	if pin.numReads() != reads {
+		t.Error("sampler kept reading after Stop")
+	}
+	if err := m.Stop(); err != nil {
+		t.Errorf("second stop failed: %v", err)
+	}
+}
+
+// haltingADC is an analog pin that records being halted, and fails to halt
+// with err if it's set.
+type haltingADC struct {
+	fakeADC
+	err    error
+	halted bool
+}
+
+func (p *haltingADC) Halt() error {
+	p.halted = true
+	return p.err
+}
+
+func TestADS1115StopHaltsEveryPin(t *testing.T) {
+	pin := &haltingADC{}
+	channels := map[ads1x15.Channel]*haltingADC{
+		ads1x15.Channel0: {err: errors.New("stuck 0")},
+		ads1x15.Channel1: {},
+		ads1x15.Channel2: {err: errors.New("stuck 2")},
+	}
+	m := &ADS1115Module{pin: pin, channels: map[ads1x15.Channel]analog.PinADC{}}
+	for ch, p := range channels {
+		m.channels[ch] = p
+	}
+
+	err := m.Stop()
+	if err == nil || !strings.Contains(err.Error(), "stuck 0") || !strings.Contains(err.Error(), "stuck 2") {
+		t.Errorf("got %v, want both halt failures", err)
+	}
+	if !pin.halted {
+		t.Error("the module's pin wasn't halted")
+	}
+	for ch, p := range channels {
+		if !p.halted {
+			t.Errorf("channel %d wasn't halted", ch)
+		}
+	}
+}
+
+// TestHTGConcurrentCalibration is only meaningful under go test -race.
+func TestHTGConcurrentCalibration(t *testing.T) {
+	pin := &fakeADC{v: physic.Volt}
+	m := &HTGModule{humidity: pin, rh: htg3535ch.NewHumidity(pin)}
+	binder := (&ManagerAgent{}).Binder
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				body := fmt.Sprintf(`{"rh_adjustment": %d}`, i*j)
+				if _, err := m.Act("calibrate", binder([]byte(body))); err != nil {
+					t.Errorf("calibrate failed: %v", err)
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := m.Act("rh", binder(nil)); err != nil {
+					t.Errorf("rh failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAnalogThresholds(t *testing.T) {
+	states := AnalogThresholds{{Min: 0, Label: "wet"}, {Min: 1.5, Label: "moist"}, {Min: 2.5, Label: "dry"}}
+	if err := states.Validate(); err != nil {
+		t.Fatalf("valid thresholds failed validation: %v", err)
+	}
+
+	for _, tc := range []struct {
+		val  float64
+		want string
+	}{
+		{-1, "wet"},
+		{0, "wet"},
+		{1.4999, "wet"},
+		{1.5, "moist"},
+		{2.4999, "moist"},
+		{2.5, "dry"},
+		{5, "dry"},
+	} {
+		if got := states.Label(tc.val); got != tc.want {
+			t.Errorf("Label(%v) = %q, want %q", tc.val, got, tc.want)
+		}
+	}
+
+	for _, invalid := range []AnalogThresholds{
+		{{Min: 0, Label: "wet"}, {Min: 0, Label: "dry"}},
+		{{Min: 1, Label: "wet"}, {Min: 0, Label: "dry"}},
+		{{Min: 0, Label: ""}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%v passed validation", invalid)
+		}
+	}
+}
+
+func TestADS1115State(t *testing.T) {
+	pin := &fakeADC{v: 2 * physic.Volt}
+	m := &ADS1115Module{pin: pin, states: AnalogThresholds{{Min: 0, Label: "wet"}, {Min: 1.5, Label: "dry"}}}
+
+	result, err := m.Act("state", (&ManagerAgent{}).Binder(nil))
+	if err != nil {
+		t.Fatalf("state failed: %v", err)
+	}
+	if want := (ADS1115StateResponse{State: "dry", Value: 2}); result != want {
+		t.Errorf("got %+v, want %+v", result, want)
+	}
+
+	m.states = nil
+	if _, err := m.Act("state", (&ManagerAgent{}).Binder(nil)); err == nil {
+		t.Error("state succeeded without any states configured")
+	}
+}
+
+func TestSettleDiscardsStaleConversions(t *testing.T) {
+	for _, tc := range []struct {
+		discard int
+		want    physic.ElectricPotential
+	}{
+		{0, 3 * physic.Volt},
+		{1, 2 * physic.Volt},
+		{2, physic.Volt},
+	} {
+		pin := &fakeADC{v: physic.Volt, queue: []physic.ElectricPotential{3 * physic.Volt, 2 * physic.Volt}}
+		sample, err := settle(pin, tc.discard).Read()
+		if err != nil {
+			t.Fatalf("discard %d: read failed: %v", tc.discard, err)
+		}
+		if sample.V != tc.want {
+			t.Errorf("discard %d: got %v, want %v", tc.discard, sample.V, tc.want)
+		}
+		if pin.numReads() != tc.discard+1 {
+			t.Errorf("discard %d: got %d conversions, want %d", tc.discard, pin.numReads(), tc.discard+1)
+		}
+	}
+}
+
+func TestDiscardConversionsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"discard_conversions": 2}`, false},
+		{`{"discard_conversions": -1}`, true},
+	} {
+		if err := bind(tc.body, &ADS1115ModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("ADS1115 %s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+		if err := bind(tc.body, &HTGModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("HTG %s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestHTGResistance(t *testing.T) {
+	pin := &fakeADC{v: 2500 * physic.MilliVolt}
+	m := &HTGModule{temperature: pin, tk: htg3535ch.NewDefaultTemperatureK(pin)}
+
+	result, err := m.Act("resistance", (&ManagerAgent{}).Binder(nil))
+	if err != nil {
+		t.Fatalf("resistance failed: %v", err)
+	}
+	resp := result.(HTGResistanceResponse)
+	if math.Abs(resp.ResistanceOhms-10000) > 1e-6 || math.Abs(resp.TemperatureK-298.15) > 0.5 {
+		t.Errorf("got %+v, want 10k ohms at about 298.15K", resp)
+	}
+}
+
+func TestHTGMeasuredVCC(t *testing.T) {
+	// half of a sagging 3.3V supply is 10k ohms, where an assumed 5V would
+	// make it about 4.9k
+	temperature := &fakeADC{v: 1650 * physic.MilliVolt}
+	vcc := &fakeADC{v: 3300 * physic.MilliVolt}
+	m := &HTGModule{temperature: temperature, vcc: vcc, tk: htg3535ch.NewCalibrationTemperatureK(temperature, vcc)}
+
+	result, err := m.Act("resistance", (&ManagerAgent{}).Binder(nil))
+	if err != nil {
+		t.Fatalf("resistance failed: %v", err)
+	}
+	if resp := result.(HTGResistanceResponse); math.Abs(resp.ResistanceOhms-10000) > 1e-6 {
+		t.Errorf("got %+v, want 10k ohms", resp)
+	}
+	result, err = m.Act("tk", (&ManagerAgent{}).Binder(nil))
+	if err != nil || math.Abs(result.(float64)-298.15) > 0.5 {
+		t.Errorf("tk got %v, %v, want about 298.15K", result, err)
+	}
+	if vcc.numReads() != 2 {
+		t.Errorf("vcc was read %d times, want once per reading", vcc.numReads())
+	}
+}
+
+func TestHTGModuleConfigVCCChannel(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{"temperature_adc_channel": 0, "humidity_adc_channel": 1}`, false},
+		{`{"temperature_adc_channel": 0, "humidity_adc_channel": 1, "vcc_adc_channel": 2}`, false},
+		{`{"temperature_adc_channel": 0, "humidity_adc_channel": 1, "vcc_adc_channel": 0}`, true},
+		{`{"temperature_adc_channel": 0, "humidity_adc_channel": 1, "vcc_adc_channel": 1}`, true},
+	} {
+		if err := bind(tc.body, &HTGModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestI2CWriteReadAndTransact(t *testing.T) {
+	bus := &i2ctest.Playback{Ops: []i2ctest.IO{
+		{Addr: 0x40, W: []byte{1, 2}},
+		{Addr: 0x40, R: []byte{9, 8}},
+		{Addr: 0x40, W: []byte{3}, R: []byte{7}},
+	}, DontPanic: true}
+	m := &I2CModule{bus: bus}
+	m.setAddress(0x40)
+	binder := (&ManagerAgent{}).Binder
+
+	for _, tc := range []struct {
+		action, body string
+		want         interface{}
+	}{
+		{"write", `{"bytes": [1, 2]}`, nil},
+		{"read", `{"length": 2}`, map[string]interface{}{"response": []byte{9, 8}}},
+		{"transact", `{"bytes": [3], "resp_len": 1}`, map[string]interface{}{"response": []byte{7}}},
+	} {
+		result, err := m.Act(tc.action, binder([]byte(tc.body)))
+		if err != nil || !reflect.DeepEqual(result, tc.want) {
+			t.Errorf("%s %s: got %v, %v, want %v", tc.action, tc.body, result, err, tc.want)
+		}
+	}
+	if err := bus.Close(); err != nil {
+		t.Error(err)
+	}
+
+	for _, tc := range []struct {
+		action, body string
+	}{
+		{"write", `{"bytes": []}`},
+		{"write", `{}`},
+		{"read", `{"length": 0}`},
+		{"transact", `{"bytes": [1], "resp_len": -1}`},
+	} {
+		var iErr InputError
+		if _, err := m.Act(tc.action, binder([]byte(tc.body))); !errors.As(err, &iErr) {
+			t.Errorf("%s %s: got %v, want an InputError", tc.action, tc.body, err)
+		}
+	}
+}
+
+func TestBytesEncodings(t *testing.T) {
+	for _, tc := range []struct {
+		bytes   string
+		want    Bytes
+		wantErr bool
+	}{
+		{`"QAA="`, Bytes{0x40, 0x00}, false},
+		{`[64, 0]`, Bytes{0x40, 0x00}, false},
+		{`[255]`, Bytes{0xFF}, false},
+		{`[]`, Bytes{}, false},
+		{`[256]`, nil, true},
+		{`[-1]`, nil, true},
+		{`[1.5]`, nil, true},
+		{`"not base64!"`, nil, true},
+	} {
+		var request I2CTransactRequest
+		err := bind(`{"bytes": `+tc.bytes+`}`, &request)
+		var iErr InputError
+		if tc.wantErr {
+			if !errors.As(err, &iErr) {
+				t.Errorf("%s: got %v, want an InputError", tc.bytes, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(request.Bytes, tc.want) {
+			t.Errorf("%s: got %v, %v, want %v", tc.bytes, request.Bytes, err, tc.want)
+		}
+	}
+}
+
+func TestI2CSetAddressRetargetsTransactions(t *testing.T) {
+	bus := &i2ctest.Record{}
+	m := &I2CModule{bus: bus}
+	m.setAddress(0x40)
+	binder := (&ManagerAgent{}).Binder
+
+	if _, err := m.Act("transact", binder([]byte(`{"bytes": [1]}`))); err != nil {
+		t.Fatalf("transact failed: %v", err)
+	}
+	if _, err := m.Act("set_address", binder([]byte(`{"address": 65}`))); err != nil {
+		t.Fatalf("set_address failed: %v", err)
+	}
+	if _, err := m.Act("transact", binder([]byte(`{"bytes": [2]}`))); err != nil {
+		t.Fatalf("transact failed: %v", err)
+	}
+
+	if len(bus.Ops) != 2 || bus.Ops[0].Addr != 0x40 || bus.Ops[1].Addr != 0x41 {
+		t.Errorf("got ops %+v, want one at 0x40 then one at 0x41", bus.Ops)
+	}
+	if pins := m.Pins(); len(pins) != 1 || pins[0] != "I2C(0x41)" {
+		t.Errorf("got pins %v after set_address", pins)
+	}
+
+	for _, body := range []string{`{"address": 2}`, `{"address": 120}`, `{}`} {
+		var iErr InputError
+		if _, err := m.Act("set_address", binder([]byte(body))); !errors.As(err, &iErr) {
+			t.Errorf("%s: got %v, want an InputError", body, err)
+		}
+	}
+	if m.addr != 0x41 {
+		t.Errorf("a rejected set_address moved the module to %#x", m.addr)
+	}
+}
+
+func TestFormatReading(t *testing.T) {
+	for _, tc := range []struct {
+		body     string
+		quantity fmt.Stringer
+		want     interface{}
+	}{
+		{`{}`, physic.ZeroCelsius + 23456*physic.MilliCelsius, 1.5},
+		{`{"formatted": false}`, 1234 * physic.MilliMetre, 1.5},
+		{`{"formatted": true}`, physic.ZeroCelsius + 23456*physic.MilliCelsius, FormattedReading{Value: 1.5, Formatted: "23.456°C"}},
+		{`{"formatted": true}`, 1234 * physic.MilliMetre, FormattedReading{Value: 1.5, Formatted: "1.234m"}},
+		{`{"formatted": true}`, physic.RelativeHumidity(45 * float64(physic.PercentRH)), FormattedReading{Value: 1.5, Formatted: "45%rH"}},
+	} {
+		got, err := formatReading((&ManagerAgent{}).Binder([]byte(tc.body)), 1.5, tc.quantity)
+		if err != nil {
+			t.Fatalf("%s %v: %v", tc.body, tc.quantity, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s %v: got %#v, want %#v", tc.body, tc.quantity, got, tc.want)
+		}
+	}
+}
+
+func TestHTGFormattedTemperature(t *testing.T) {
+	pin := &fakeADC{v: 2500 * physic.MilliVolt}
+	m := &HTGModule{temperature: pin, tk: htg3535ch.NewDefaultTemperatureK(pin)}
+
+	for _, action := range []string{"tk", "tc", "tf"} {
+		result, err := m.Act(action, (&ManagerAgent{}).Binder([]byte(`{"formatted": true}`)))
+		if err != nil {
+			t.Fatalf("%s failed: %v", action, err)
+		}
+		reading := result.(FormattedReading)
+		if !strings.HasSuffix(reading.Formatted, "°C") || !strings.HasPrefix(reading.Formatted, "2") {
+			t.Errorf("%s: got formatted %q, want about 25°C", action, reading.Formatted)
+		}
+	}
+}
+
+// stuckPin is a pin that always reads low, whatever it's driven to.
+type stuckPin struct {
+	*gpiotest.Pin
+}
+
+func (stuckPin) Read() gpio.Level { return gpio.Low }
+
+// outputOnlyPin hides a pin's input side.
+type outputOnlyPin struct {
+	gpio.PinOut
+}
+
+func TestRelaySetReadback(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pin      func(*gpiotest.Pin) gpio.PinOut
+		inverted bool
+		want     RelaySetResponse
+	}{
+		{"match", func(p *gpiotest.Pin) gpio.PinOut { return p }, false, RelaySetResponse{Commanded: true, ReadbackAvailable: true, Observed: ptr(true)}},
+		{"match inverted", func(p *gpiotest.Pin) gpio.PinOut { return p }, true, RelaySetResponse{Commanded: true, ReadbackAvailable: true, Observed: ptr(true)}},
+		{"mismatch", func(p *gpiotest.Pin) gpio.PinOut { return stuckPin{p} }, false, RelaySetResponse{Commanded: true, ReadbackAvailable: true, Observed: ptr(false), Mismatch: true}},
+		{"output only", func(p *gpiotest.Pin) gpio.PinOut { return outputOnlyPin{p} }, false, RelaySetResponse{Commanded: true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &RelayModule{pin: tc.pin(&gpiotest.Pin{N: "READBACK"}), readback: true, inverted: tc.inverted}
+
+			result, err := m.Act("set", (&ManagerAgent{}).Binder([]byte(`{"high": true}`)))
+			if err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			if got := result.(RelaySetResponse); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	m := &RelayModule{pin: &gpiotest.Pin{N: "NO_READBACK"}}
+	if result, err := m.Act("set", (&ManagerAgent{}).Binder([]byte(`{"high": true}`))); err != nil || result != nil {
+		t.Errorf("set without readback got %v, %v, want nothing", result, err)
+	}
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestADS1115ReportsRange(t *testing.T) {
+	pin := &fakeADC{v: physic.Volt}
+	m := &ADS1115Module{pin: pin, channel: 4}
+	binder := (&ManagerAgent{}).Binder
+
+	result, err := m.Act("config", binder(nil))
+	if err != nil {
+		t.Fatalf("config failed: %v", err)
+	}
+	config := result.(ADS1115ConfigResponse)
+	if config.Channel != 4 || config.RangeMinVolts != 0 || config.RangeMaxVolts != 4 {
+		t.Errorf("got %+v, want channel 4 with range 0-4V", config)
+	}
+
+	result, err = m.Act("read", binder([]byte(`{"full_scale": true}`)))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	reading := result.(ADS1115Reading)
+	if reading.PercentOfFullScale == nil || *reading.PercentOfFullScale != 25 {
+		t.Errorf("got %+v, want 25%% of full scale", reading)
+	}
+}
+
+func TestADS1115ReadUntil(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		body        string
+		wantMet     bool
+		wantSamples int
+		wantValue   float64
+	}{
+		{"crosses above", `{"threshold": 2, "interval_ms": 0}`, true, 3, 2},
+		{"crosses below", `{"threshold": 0.5, "comparison": "below", "interval_ms": 0}`, true, 4, 0.5},
+		{"times out", `{"threshold": 10, "interval_ms": 5, "timeout_ms": 30}`, false, 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pin := &fakeADC{v: physic.Volt, queue: []physic.ElectricPotential{
+				physic.Volt, 1500 * physic.MilliVolt, 2 * physic.Volt, 500 * physic.MilliVolt,
+			}}
+			m := &ADS1115Module{pin: pin}
+
+			result, err := m.Act("read_until", (&ManagerAgent{}).Binder([]byte(tc.body)))
+			if err != nil {
+				t.Fatalf("read_until failed: %v", err)
+			}
+			resp := result.(ADS1115ReadUntilResponse)
+			if resp.Met != tc.wantMet || resp.Value != tc.wantValue {
+				t.Errorf("got %+v, want met %v at %v", resp, tc.wantMet, tc.wantValue)
+			}
+			if tc.wantMet && resp.Samples != tc.wantSamples {
+				t.Errorf("got %d samples, want %d", resp.Samples, tc.wantSamples)
+			}
+			if !tc.wantMet && (resp.ElapsedMS < 25 || resp.Samples < 2) {
+				t.Errorf("gave up early: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestADS1115ReadUntilRequest(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"comparison": "below", "interval_ms": 0, "timeout_ms": 60000}`, false},
+		{`{"comparison": "equal"}`, true},
+		{`{"interval_ms": -1}`, true},
+		{`{"timeout_ms": 0}`, true},
+		{`{"timeout_ms": 60001}`, true},
+	} {
+		if err := bind(tc.body, &ADS1115ReadUntilRequest{}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestTransferTable(t *testing.T) {
+	table := TransferTable{{Volts: 0.5, Value: 0}, {Volts: 1.5, Value: 100}, {Volts: 4.5, Value: 400}}
+	if err := table.Validate(); err != nil {
+		t.Fatalf("valid table failed validation: %v", err)
+	}
+
+	for _, tc := range []struct {
+		v    float64
+		want float64
+	}{
+		{0, 0},
+		{0.5, 0},
+		{1, 50},
+		{1.5, 100},
+		{3, 250},
+		{4.5, 400},
+		{5, 400},
+	} {
+		if got := table.Apply(tc.v); math.Abs(got-tc.want) > 1e-9 {
+			t.Errorf("Apply(%v) = %v, want %v", tc.v, got, tc.want)
+		}
+	}
+	if got := (TransferTable{}).Apply(1.23); got != 1.23 {
+		t.Errorf("an empty table mapped 1.23 to %v", got)
+	}
+
+	for _, invalid := range []TransferTable{
+		{{Volts: 1, Value: 0}},
+		{{Volts: 1, Value: 0}, {Volts: 1, Value: 1}},
+		{{Volts: 2, Value: 0}, {Volts: 1, Value: 1}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Errorf("%v passed validation", invalid)
+		}
+	}
+}
+
+func TestADS1115ReadAppliesTransfer(t *testing.T) {
+	m := &ADS1115Module{pin: &fakeADC{v: 3 * physic.Volt}, transfer: TransferTable{{Volts: 0.5, Value: 0}, {Volts: 4.5, Value: 400}}}
+	if result, err := m.Act("read", (&ManagerAgent{}).Binder(nil)); err != nil || result != 250.0 {
+		t.Errorf("read got %v, %v, want 250", result, err)
+	}
+}
+
+func TestRGBLEDDuties(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		color       string
+		commonAnode bool
+		want        [3]gpio.Duty
+	}{
+		{"black", `{}`, false, [3]gpio.Duty{0, 0, 0}},
+		{"white", `{"r": 255, "g": 255, "b": 255}`, false, [3]gpio.Duty{gpio.DutyMax, gpio.DutyMax, gpio.DutyMax}},
+		{"orange", `{"r": 255, "g": 51, "b": 0}`, false, [3]gpio.Duty{gpio.DutyMax, gpio.DutyMax / 5, 0}},
+		{"orange anode", `{"r": 255, "g": 51, "b": 0}`, true, [3]gpio.Duty{0, gpio.DutyMax - gpio.DutyMax/5, gpio.DutyMax}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pins := [3]*gpiotest.Pin{{N: "R"}, {N: "G"}, {N: "B"}}
+			m := &RGBLEDModule{red: pins[0], green: pins[1], blue: pins[2], commonAnode: tc.commonAnode, frequency: physic.KiloHertz}
+
+			if _, err := m.Act("set", (&ManagerAgent{}).Binder([]byte(tc.color))); err != nil {
+				t.Fatalf("set failed: %v", err)
+			}
+			for i, pin := range pins {
+				if pin.D != tc.want[i] || pin.F != physic.KiloHertz {
+					t.Errorf("pin %s: got %v at %v, want %v at 1kHz", pin.N, pin.D, pin.F, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRGBLEDValidation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		ptr     interface{}
+		wantErr bool
+	}{
+		{`{"red_pin": "1", "green_pin": "2", "blue_pin": "3"}`, &RGBLEDModuleConfig{}, false},
+		{`{"red_pin": "1", "green_pin": "2"}`, &RGBLEDModuleConfig{}, true},
+		{`{"red_pin": "1", "green_pin": "2", "blue_pin": "3", "frequency_hz": 0}`, &RGBLEDModuleConfig{}, true},
+		{`{"r": 0, "g": 255}`, &RGBLEDSetRequest{}, false},
+		{`{"r": 256}`, &RGBLEDSetRequest{}, true},
+		{`{"b": -1}`, &RGBLEDSetRequest{}, true},
+	} {
+		err := bind(tc.body, tc.ptr)
+		var iErr InputError
+		if tc.wantErr != errors.As(err, &iErr) {
+			t.Errorf("%s: got error %v, want an InputError: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestADSReadAll(t *testing.T) {
+	// the playback bus has no conversions to replay, so any channel that
+	// isn't cached fails
+	ads, err := ads1x15.NewADS1115(&i2ctest.Playback{DontPanic: true}, &ads1x15.DefaultOpts)
+	if err != nil {
+		t.Fatalf("failed creating ADS1115: %v", err)
+	}
+	settings := ADCSettings{MaxVoltage: 4.096, FrequencyHZ: 8, Quality: ADCQualityBestQuality}
+
+	cached := []*fakeADC{{v: 500 * physic.MilliVolt}, {v: 1 * physic.Volt}, {v: 1500 * physic.MilliVolt}, {v: 2 * physic.Volt}}
+	for _, tc := range []struct {
+		name       string
+		cached     int
+		wantValues map[string]float64
+		wantErrors []string
+	}{
+		{"all cached", 4, map[string]float64{"0": 0.5, "1": 1, "2": 1.5, "3": 2}, nil},
+		{"some fail", 2, map[string]float64{"0": 0.5, "1": 1}, []string{"2", "3"}},
+	} {
+		m := &ADS1115Module{ads: ads, settings: settings, channels: map[ads1x15.Channel]analog.PinADC{}}
+		for i, ch := range []ads1x15.Channel{ads1x15.Channel0, ads1x15.Channel1, ads1x15.Channel2, ads1x15.Channel3}[:tc.cached] {
+			m.channels[ch] = cached[i]
+		}
+
+		result, err := m.Act("read_all", (&ManagerAgent{}).Binder(nil))
+		if err != nil {
+			t.Fatalf("%s: read_all failed: %v", tc.name, err)
+		}
+		resp := result.(ADS1115ReadAllResponse)
+		if !reflect.DeepEqual(resp.Values, tc.wantValues) {
+			t.Errorf("%s: got values %v, want %v", tc.name, resp.Values, tc.wantValues)
+		}
+		var failed []string
+		for ch := range resp.Errors {
+			failed = append(failed, ch)
+		}
+		sort.Strings(failed)
+		if !reflect.DeepEqual(failed, tc.wantErrors) {
+			t.Errorf("%s: got errors %v, want them for channels %v", tc.name, resp.Errors, tc.wantErrors)
+		}
+		if len(m.channels) != 4 {
+			t.Errorf("%s: cached %d channels, want all 4", tc.name, len(m.channels))
+		}
+	}
+
+	m := &ADS1115Module{ads: ads, settings: settings, channels: map[ads1x15.Channel]analog.PinADC{}}
+	if _, err := m.Act("read_all", (&ManagerAgent{}).Binder(nil)); err == nil {
+		t.Error("read_all succeeded with every channel failing")
+	}
+}
+
+func TestADCSettingsPinRange(t *testing.T) {
+	ads, err := ads1x15.NewADS1115(&i2ctest.Record{}, &ads1x15.DefaultOpts)
+	if err != nil {
+		t.Fatalf("failed creating ADS1115: %v", err)
+	}
+
+	for _, volts := range ADCPGARanges {
+		settings := ADCSettings{MaxVoltage: volts, FrequencyHZ: 8, Quality: ADCQualityBestQuality}
+		pin, err := settings.pinForChannel(ads, int(ads1x15.Channel1))
+		if err != nil {
+			t.Fatalf("%vV: %v", volts, err)
+		}
+		if _, max := pin.Range(); max.V != physic.ElectricPotential(volts*float64(physic.Volt)) {
+			t.Errorf("%vV: pin has range up to %v", volts, max.V)
+		}
+		pin.Halt()
+	}
+}
+
+func TestADCSettingsValidation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"max_voltage": 2.048, "frequency_hz": 860, "quality": "save_energy"}`, false},
+		{`{"max_voltage": 5}`, true},
+		{`{"frequency_hz": 0}`, true},
+		{`{"frequency_hz": 861}`, true},
+		{`{"quality": "perfect"}`, true},
+	} {
+		for _, config := range []interface{}{&ADS1115ModuleConfig{}, &HTGModuleConfig{}} {
+			err := bind(tc.body, config)
+			var iErr InputError
+			if tc.wantErr != errors.As(err, &iErr) {
+				t.Errorf("%T %s: got error %v, want an InputError: %v", config, tc.body, err, tc.wantErr)
+			}
+		}
+	}
+
+	var config ADS1115ModuleConfig
+	if err := bind(`{}`, &config); err != nil || config.MaxVoltage != DefaultADCMaxVoltage || config.FrequencyHZ != DefaultADCFrequencyHZ {
+		t.Errorf("got defaults %+v, %v", config.ADCSettings, err)
+	}
+}
+
+func TestGPIOInput(t *testing.T) {
+	pin := testPin(t, "INPUT_PIN")
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"button": {Source: "input", Config: json.RawMessage(`{"pin": "INPUT_PIN", "pull": "up"}`)},
+	})
+
+	if result, err := mgr.Act("button", "", mgr.Binder(nil)); err != nil || result != (GPIOInputReading{High: true}) {
+		t.Errorf("read got %v, %v, want high", result, err)
+	}
+
+	// wait_edge flushes queued edges when it starts, so fire one in a bit
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pin.EdgesChan <- gpio.Low
+	}()
+	result, err := mgr.Act("button", "wait_edge", mgr.Binder([]byte(`{"edge": "falling", "timeout_ms": 1000}`)))
+	if err != nil || result != (GPIOWaitEdgeResponse{EdgeDetected: true, High: false}) {
+		t.Errorf("wait_edge with an edge got %+v, %v", result, err)
+	}
+
+	start := time.Now()
+	result, err = mgr.Act("button", "wait_edge", mgr.Binder([]byte(`{"timeout_ms": 30}`)))
+	if err != nil || result.(GPIOWaitEdgeResponse).EdgeDetected {
+		t.Errorf("wait_edge without an edge got %+v, %v", result, err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("wait_edge timed out after %s, want 30ms", elapsed)
+	}
+}
+
+func TestGPIOInputValidation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		ptr     interface{}
+		wantErr bool
+	}{
+		{`{"pin": "1"}`, &GPIOInputModuleConfig{}, false},
+		{`{"pin": "1", "pull": "down"}`, &GPIOInputModuleConfig{}, false},
+		{`{}`, &GPIOInputModuleConfig{}, true},
+		{`{"pin": "1", "pull": "sideways"}`, &GPIOInputModuleConfig{}, true},
+		{`{}`, &GPIOWaitEdgeRequest{}, false},
+		{`{"edge": "up"}`, &GPIOWaitEdgeRequest{}, true},
+		{`{"timeout_ms": 0}`, &GPIOWaitEdgeRequest{}, true},
+		{`{"timeout_ms": 60001}`, &GPIOWaitEdgeRequest{}, true},
+	} {
+		if err := bind(tc.body, tc.ptr); (err != nil) != tc.wantErr {
+			t.Errorf("%T %s: got error %v, want error: %v", tc.ptr, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPIRMotion(t *testing.T) {
+	pin := testPin(t, "PIR_PIN")
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{
+		"pir": {Source: "pir", Config: json.RawMessage(`{"pin": "PIR_PIN"}`)},
+	})
+	setLevel := func(l gpio.Level) {
+		pin.Lock()
+		defer pin.Unlock()
+		pin.L = l
+	}
+
+	// pulled down, a quiet sensor reads low
+	if result, err := mgr.Act("pir", "read", mgr.Binder(nil)); err != nil || result != (PIRMotionResponse{}) {
+		t.Errorf("read got %+v, %v, want no motion", result, err)
+	}
+	setLevel(gpio.High)
+	if result, err := mgr.Act("pir", "", mgr.Binder(nil)); err != nil || result != (PIRMotionResponse{Motion: true}) {
+		t.Errorf("read got %+v, %v, want motion", result, err)
+	}
+	if result, err := mgr.Act("pir", "wait_motion", mgr.Binder([]byte(`{"timeout_ms": 30}`))); err != nil || result != (PIRMotionResponse{Motion: true}) {
+		t.Errorf("wait_motion during motion got %+v, %v, want motion", result, err)
+	}
+
+	setLevel(gpio.Low)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pin.EdgesChan <- gpio.High
+	}()
+	if result, err := mgr.Act("pir", "wait_motion", mgr.Binder([]byte(`{"timeout_ms": 1000}`))); err != nil || result != (PIRMotionResponse{Motion: true}) {
+		t.Errorf("wait_motion with an edge got %+v, %v, want motion", result, err)
+	}
+	if result, err := mgr.Act("pir", "wait_motion", mgr.Binder([]byte(`{"timeout_ms": 30}`))); err != nil || result != (PIRMotionResponse{}) {
+		t.Errorf("wait_motion without an edge got %+v, %v, want no motion", result, err)
+	}
+}
+
+// levelRecorder is an output pin that records every level driven on it.
+type levelRecorder struct {
+	*gpiotest.Pin
+	levels []gpio.Level
+}
+
+func (p *levelRecorder) Out(l gpio.Level) error {
+	p.levels = append(p.levels, l)
+	return p.Pin.Out(l)
+}
+
+func TestStepperCoilSequence(t *testing.T) {
+	const H, L = gpio.High, gpio.Low
+	for _, tc := range []struct {
+		name   string
+		action string
+		body   string
+		hold   bool
+		want   [][4]gpio.Level
+	}{
+		{"cw", "step", `{"steps": 3}`, false, [][4]gpio.Level{{H, H, L, L}, {L, H, L, L}, {L, H, H, L}, {L, L, L, L}}},
+		{"ccw", "step", `{"steps": 3, "direction": "ccw"}`, false, [][4]gpio.Level{{H, L, L, H}, {L, L, L, H}, {L, L, H, H}, {L, L, L, L}}},
+		{"rotate holding", "rotate", `{"degrees": -90}`, true, [][4]gpio.Level{{H, L, L, H}, {L, L, L, H}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var pins [4]*levelRecorder
+			m := &StepperModule{stepsPerRev: 8, stepDelay: time.Microsecond, hold: tc.hold}
+			for i := range pins {
+				pins[i] = &levelRecorder{Pin: &gpiotest.Pin{N: fmt.Sprintf("COIL%d", i)}}
+				m.pins[i] = pins[i]
+			}
+
+			result, err := m.Act(tc.action, (&ManagerAgent{}).Binder([]byte(tc.body)))
+			if err != nil {
+				t.Fatalf("%s failed: %v", tc.action, err)
+			}
+
+			var frames [][4]gpio.Level
+			for k := range pins[0].levels {
+				var frame [4]gpio.Level
+				for i, pin := range pins {
+					frame[i] = pin.levels[k]
+				}
+				frames = append(frames, frame)
+			}
+			if !reflect.DeepEqual(frames, tc.want) {
+				t.Errorf("got coil frames %v, want %v", frames, tc.want)
+			}
+
+			steps := len(tc.want)
+			if !tc.hold {
+				steps--
+			}
+			if tc.name != "cw" {
+				steps = -steps
+			}
+			if want := (StepperMoveResponse{Steps: steps, Position: steps}); result != want {
+				t.Errorf("got %+v, want %+v", result, want)
+			}
+		})
+	}
+}
+
+func TestStepperValidation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		ptr     interface{}
+		wantErr bool
+	}{
+		{`{"pins": ["1", "2", "3", "4"]}`, &StepperModuleConfig{}, false},
+		{`{"pins": ["1", "2", "3"]}`, &StepperModuleConfig{}, true},
+		{`{"pins": ["1", "2", "3", "4"], "step_delay_ms": 0}`, &StepperModuleConfig{}, true},
+		{`{"pins": ["1", "2", "3", "4"], "steps_per_rev": -1}`, &StepperModuleConfig{}, true},
+		{`{"steps": 10}`, &StepperStepRequest{}, false},
+		{`{"steps": -1}`, &StepperStepRequest{}, true},
+		{`{"direction": "up"}`, &StepperStepRequest{}, true},
+	} {
+		if err := bind(tc.body, tc.ptr); (err != nil) != tc.wantErr {
+			t.Errorf("%T %s: got error %v, want error: %v", tc.ptr, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRelayInverted(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	for _, tc := range []struct {
+		inverted             bool
+		wantInitial, wantSet gpio.Level
+	}{
+		{false, gpio.Low, gpio.High},
+		{true, gpio.High, gpio.Low},
+	} {
+		pin := testPin(t, fmt.Sprintf("RELAY_INVERTED_%v", tc.inverted))
+		m := &RelayModule{}
+		if err := m.Initialize(&ServiceAgent{}, binder([]byte(fmt.Sprintf(`{"pin": "%s", "inverted": %v}`, pin.N, tc.inverted)))); err != nil {
+			t.Fatalf("initialize failed: %v", err)
+		}
+		if got := level(pin); got != tc.wantInitial {
+			t.Errorf("inverted %v: initial_state off drove %s, want %s", tc.inverted, got, tc.wantInitial)
+		}
+
+		if _, err := m.Act("set", binder([]byte(`{"high": true}`))); err != nil {
+			t.Fatalf("set failed: %v", err)
+		}
+		if got := level(pin); got != tc.wantSet {
+			t.Errorf("inverted %v: high=true drove %s, want %s", tc.inverted, got, tc.wantSet)
+		}
+	}
+}
+
+func TestRelayToggleAndPulse(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	pin := &levelRecorder{Pin: &gpiotest.Pin{N: "TOGGLE"}}
+	m := &RelayModule{pin: pin}
+
+	for i, want := range []bool{true, false, true} {
+		result, err := m.Act("toggle", binder(nil))
+		if err != nil {
+			t.Fatalf("toggle failed: %v", err)
+		}
+		if got := result.(RelaySetResponse); got.Commanded != want {
+			t.Errorf("toggle %d: got %+v, want commanded %v", i, got, want)
+		}
+	}
+
+	pin.levels = nil
+	start := time.Now()
+	result, err := m.Act("pulse", binder([]byte(`{"ms": 50, "high": false}`)))
+	if err != nil {
+		t.Fatalf("pulse failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("pulse reverted after %s, want at least 50ms", elapsed)
+	}
+	if want := []gpio.Level{gpio.Low, gpio.High}; !reflect.DeepEqual(pin.levels, want) {
+		t.Errorf("pulse drove %v, want %v", pin.levels, want)
+	}
+	if got := result.(RelaySetResponse); !got.Commanded {
+		t.Errorf("got %+v after the pulse, want it back on", got)
+	}
+}
+
+func TestRelayPulseRequestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		request RelayPulseRequest
+		wantErr bool
+	}{
+		{RelayPulseRequest{MS: 100}, false},
+		{RelayPulseRequest{MS: int(MaxRelayPulse.Milliseconds())}, false},
+		{RelayPulseRequest{MS: 0}, true},
+		{RelayPulseRequest{MS: int(MaxRelayPulse.Milliseconds()) + 1}, true},
+	} {
+		if err := tc.request.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v, want error: %v", tc.request, err, tc.wantErr)
+		}
+	}
+}
+
+func TestPCA9685RegisterWrites(t *testing.T) {
+	bus := &i2ctest.Record{}
+	m := &PCA9685Module{dvc: &i2c.Dev{Bus: bus, Addr: 0x40}, addr: 0x40, frequency: 50}
+	binder := (&ManagerAgent{}).Binder
+
+	// 25MHz / (4096 * 50Hz) - 1 rounds to a prescale of 121
+	if err := m.setFrequency(); err != nil {
+		t.Fatalf("setFrequency failed: %v", err)
+	}
+	for _, tc := range []struct {
+		action, body string
+		want         []byte
+	}{
+		{"set_channel", `{"channel": 3, "duty_ratio": 0.25}`, []byte{0x12, 0, 0, 0x00, 0x04}},
+		{"set_channel", `{"channel": 15, "duty_ratio": 0}`, []byte{0x42, 0, 0, 0, 0x10}},
+		{"set_channel", `{"channel": 0, "duty_ratio": 1}`, []byte{0x06, 0, 0x10, 0, 0}},
+		// a 1.5ms pulse is 7.5% of a 20ms period, or 307 counts
+		{"set_servo_angle", `{"channel": 1, "angle": 90}`, []byte{0x0A, 0, 0, 0x33, 0x01}},
+	} {
+		if _, err := m.Act(tc.action, binder([]byte(tc.body))); err != nil {
+			t.Fatalf("%s %s failed: %v", tc.action, tc.body, err)
+		}
+	}
+
+	want := [][]byte{
+		{0x00, 0x10}, {0xFE, 121}, {0x00, 0x20}, {0x00, 0xA0},
+		{0x12, 0, 0, 0x00, 0x04},
+		{0x42, 0, 0, 0, 0x10},
+		{0x06, 0, 0x10, 0, 0},
+		{0x0A, 0, 0, 0x33, 0x01},
+	}
+	var got [][]byte
+	for _, op := range bus.Ops {
+		if op.Addr != 0x40 {
+			t.Errorf("got a write to %#x, want 0x40", op.Addr)
+		}
+		got = append(got, op.W)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got writes %x, want %x", got, want)
+	}
+}
+
+func TestPCA9685Validation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		ptr     interface{}
+		wantErr bool
+	}{
+		{`{}`, &PCA9685ModuleConfig{}, false},
+		{`{"frequency_hz": 1526}`, &PCA9685ModuleConfig{}, false},
+		{`{"frequency_hz": 10}`, &PCA9685ModuleConfig{}, true},
+		{`{"frequency_hz": 2000}`, &PCA9685ModuleConfig{}, true},
+		{`{"channel": 15, "duty_ratio": 0.5}`, &PCA9685SetChannelRequest{}, false},
+		{`{"channel": 16, "duty_ratio": 0.5}`, &PCA9685SetChannelRequest{}, true},
+		{`{"channel": -1, "duty_ratio": 0.5}`, &PCA9685SetChannelRequest{}, true},
+		{`{"channel": 0, "duty_ratio": 1.5}`, &PCA9685SetChannelRequest{}, true},
+		{`{"channel": 0, "angle": 180}`, &PCA9685ServoRequest{}, false},
+		{`{"channel": 0, "angle": 181}`, &PCA9685ServoRequest{}, true},
+		{`{"channel": 0, "angle": 90, "min_pulse_us": 2000}`, &PCA9685ServoRequest{}, true},
+	} {
+		if err := bind(tc.body, tc.ptr); (err != nil) != tc.wantErr {
+			t.Errorf("%T %s: got error %v, want error: %v", tc.ptr, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+// bme280Playback replays a BMP280 or BME280, identified by chipID, starting
+// up and taking two readings. The registers are the ones periph's own bmxx80
+// tests use.
+func bme280Playback(chipID byte) *i2ctest.Playback {
+	calibration := []byte{0x10, 0x6e, 0x6c, 0x66, 0x32, 0x0, 0x5d, 0x95, 0xb8, 0xd5, 0xd0, 0xb, 0x77, 0x1e, 0x9d, 0xff, 0xf9, 0xff, 0xac, 0x26, 0xa, 0xd8, 0xbd, 0x10, 0x0, 0x4b}
+	ops := []i2ctest.IO{
+		{Addr: 0x76, W: []byte{0xd0}, R: []byte{chipID}},
+		{Addr: 0x76, W: []byte{0x88}, R: calibration},
+	}
+	raw := []byte{0x4a, 0x52, 0xc0, 0x80, 0x96, 0xc0}
+	if chipID == 0x60 {
+		ops = append(ops,
+			i2ctest.IO{Addr: 0x76, W: []byte{0xe1}, R: []byte{0x6e, 0x1, 0x0, 0x13, 0x5, 0x0, 0x1e}},
+			i2ctest.IO{Addr: 0x76, W: []byte{0xf4, 0x6c, 0xf2, 0x3, 0xf5, 0xa0, 0xf4, 0x6c}},
+		)
+		raw = append(raw, 0x7a, 0x76)
+	} else {
+		ops = append(ops, i2ctest.IO{Addr: 0x76, W: []byte{0xf4, 0x6c, 0xf5, 0xa0, 0xf4, 0x6c}})
+	}
+	for i := 0; i < 2; i++ {
+		ops = append(ops,
+			i2ctest.IO{Addr: 0x76, W: []byte{0xf4, 0x6d}},
+			i2ctest.IO{Addr: 0x76, W: []byte{0xf3}, R: []byte{0}},
+			i2ctest.IO{Addr: 0x76, W: []byte{0xf7}, R: raw},
+		)
+	}
+	return &i2ctest.Playback{Ops: ops, DontPanic: true}
+}
+
+func TestBME280Read(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	for _, tc := range []struct {
+		name   string
+		chipID byte
+		want   BME280Reading
+	}{
+		{"BME280", 0x60, BME280Reading{TemperatureC: 23.72, PressurePa: 100942.6953125, RH: ptr(65.3056)}},
+		{"BMP280", 0x58, BME280Reading{TemperatureC: 23.72, PressurePa: 100942.6953125}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &BME280Module{}
+			sp := &ServiceAgent{defaultI2CBus: bme280Playback(tc.chipID)}
+			if err := m.Initialize(sp, binder(nil)); err != nil {
+				t.Fatalf("initialize failed: %v", err)
+			}
+
+			result, err := m.Act("read", binder(nil))
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			got := result.(BME280Reading)
+			if math.Abs(got.TemperatureC-tc.want.TemperatureC) > 1e-6 || math.Abs(got.PressurePa-tc.want.PressurePa) > 1e-6 ||
+				(got.RH == nil) != (tc.want.RH == nil) || (got.RH != nil && math.Abs(*got.RH-*tc.want.RH) > 1e-6) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+
+			if _, err := m.Act("rh", binder(nil)); (err == nil) != (tc.want.RH != nil) {
+				t.Errorf("rh got error %v", err)
+			}
+		})
+	}
+}
+
+func TestBME280RejectsOtherChips(t *testing.T) {
+	sp := &ServiceAgent{defaultI2CBus: &i2ctest.Playback{
+		Ops:       []i2ctest.IO{{Addr: 0x76, W: []byte{0xd0}, R: []byte{0x55}}},
+		DontPanic: true,
+	}}
+	if err := (&BME280Module{}).Initialize(sp, (&ManagerAgent{}).Binder(nil)); err == nil || !strings.Contains(err.Error(), "0x76") {
+		t.Errorf("got error %v, want one naming the address", err)
+	}
+}
+
+// spiPlayback connects to a port that replays ops.
+func spiPlayback(t *testing.T, ops ...conntest.IO) (*spitest.Playback, spi.Conn) {
+	t.Helper()
+	port := &spitest.Playback{Playback: conntest.Playback{Ops: ops, DontPanic: true}}
+	conn, err := port.Connect(physic.MegaHertz, spi.Mode0, 8)
+	if err != nil {
+		t.Fatalf("failed connecting to playback port: %v", err)
+	}
+	return port, conn
+}
+
+func TestSPITransact(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	for _, tc := range []struct {
+		body string
+		op   conntest.IO
+		want []byte
+	}{
+		{`{"bytes": [1, 2]}`, conntest.IO{W: []byte{1, 2}, R: []byte{9, 8}}, []byte{9, 8}},
+		// reading more than is written pads the write with zeroes
+		{`{"bytes": [1, 2], "resp_len": 4}`, conntest.IO{W: []byte{1, 2, 0, 0}, R: []byte{9, 8, 7, 6}}, []byte{9, 8, 7, 6}},
+	} {
+		port, conn := spiPlayback(t, tc.op)
+		m := &SPIModule{port: port, conn: conn}
+
+		result, err := m.Act("transact", binder([]byte(tc.body)))
+		if err != nil {
+			t.Fatalf("%s: transact failed: %v", tc.body, err)
+		}
+		if got := result.(map[string]interface{})["response"]; !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got response %v, want %v", tc.body, got, tc.want)
+		}
+		if err := m.Stop(); err != nil {
+			t.Errorf("%s: %v", tc.body, err)
+		}
+	}
+}
+
+func TestSPIModuleConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{}`, false},
+		{`{"port": "SPI0.1", "mode": 3, "bits": 16}`, false},
+		{`{"speed_hz": 0}`, true},
+		{`{"mode": 4}`, true},
+		{`{"bits": 0}`, true},
+	} {
+		if err := bind(tc.body, &SPIModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestMCP3008Read(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	for _, tc := range []struct {
+		channel int
+		op      conntest.IO
+		want    MCP3008Reading
+	}{
+		{0, conntest.IO{W: []byte{0x01, 0x80, 0x00}, R: []byte{0x00, 0x00, 0x00}}, MCP3008Reading{Channel: 0, Raw: 0, Volts: 0}},
+		// bits above the 10-bit result are ignored
+		{5, conntest.IO{W: []byte{0x01, 0xD0, 0x00}, R: []byte{0xFF, 0xFE, 0x00}}, MCP3008Reading{Channel: 5, Raw: 512, Volts: 1.65}},
+		{7, conntest.IO{W: []byte{0x01, 0xF0, 0x00}, R: []byte{0x00, 0x03, 0xFF}}, MCP3008Reading{Channel: 7, Raw: 1023, Volts: 3.3 * 1023 / 1024}},
+	} {
+		port, conn := spiPlayback(t, tc.op)
+		m := &MCP3008Module{spi: SPIModule{port: port, conn: conn}, vref: 3.3}
+
+		result, err := m.Act("read", binder([]byte(fmt.Sprintf(`{"channel": %d}`, tc.channel))))
+		if err != nil {
+			t.Fatalf("channel %d: read failed: %v", tc.channel, err)
+		}
+		got := result.(MCP3008Reading)
+		if got.Channel != tc.want.Channel || got.Raw != tc.want.Raw || math.Abs(got.Volts-tc.want.Volts) > 1e-9 {
+			t.Errorf("channel %d: got %+v, want %+v", tc.channel, got, tc.want)
+		}
+	}
+}
+
+func TestMCP3008Validation(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		ptr     interface{}
+		wantErr bool
+	}{
+		{`{}`, &MCP3008ModuleConfig{}, false},
+		{`{"vref_volts": 5}`, &MCP3008ModuleConfig{}, false},
+		{`{"vref_volts": 0}`, &MCP3008ModuleConfig{}, true},
+		{`{"speed_hz": 0}`, &MCP3008ModuleConfig{}, true},
+		{`{"channel": 7}`, &MCP3008ReadRequest{}, false},
+		{`{"channel": 8}`, &MCP3008ReadRequest{}, true},
+		{`{"channel": -1}`, &MCP3008ReadRequest{}, true},
+	} {
+		if err := bind(tc.body, tc.ptr); (err != nil) != tc.wantErr {
+			t.Errorf("%T %s: got error %v, want error: %v", tc.ptr, tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRelayInitialAndSafeStates(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	for _, tc := range []struct {
+		initial, safe         string
+		inverted              bool
+		wantInitial, wantStop gpio.Level
+	}{
+		{"off", "", false, gpio.Low, gpio.Low},
+		{"on", "", false, gpio.High, gpio.High},
+		{"off", "", true, gpio.High, gpio.High},
+		{"on", "", true, gpio.Low, gpio.Low},
+		{"on", "off", false, gpio.High, gpio.Low},
+		{"off", "on", false, gpio.Low, gpio.High},
+		{"on", "off", true, gpio.Low, gpio.High},
+		{"off", "on", true, gpio.High, gpio.Low},
+	} {
+		name := fmt.Sprintf("initial %s, safe %q, inverted %v", tc.initial, tc.safe, tc.inverted)
+		pin := testPin(t, "RELAY_STATES")
+		config := fmt.Sprintf(`{"pin": "%s", "initial_state": "%s", "safe_state": "%s", "inverted": %v}`, pin.N, tc.initial, tc.safe, tc.inverted)
+
+		m := &RelayModule{}
+		if err := m.Initialize(&ServiceAgent{}, binder([]byte(config))); err != nil {
+			t.Fatalf("%s: initialize failed: %v", name, err)
+		}
+		if got := level(pin); got != tc.wantInitial {
+			t.Errorf("%s: drove %s at boot, want %s", name, got, tc.wantInitial)
+		}
+		// with no safe state, Stop leaves the relay as it was
+		if err := m.Stop(); err != nil {
+			t.Fatalf("%s: stop failed: %v", name, err)
+		}
+		if got := level(pin); got != tc.wantStop {
+			t.Errorf("%s: drove %s on stop, want %s", name, got, tc.wantStop)
+		}
+	}
+}
+
+// pinProvider is a ServiceAgent that looks GPIO pins up in pins.
+type pinProvider struct {
+	*ServiceAgent
+	pins map[string]gpio.PinIO
+}
+
+func (p pinProvider) GetGPIOByName(name string) (gpio.PinIO, error) {
+	return p.pins[name], nil
+}
+
+// brokenPin is a pin that can't be driven.
+type brokenPin struct {
+	*gpiotest.Pin
+}
+
+func (brokenPin) Out(gpio.Level) error { return errors.New("broken") }
+
+// haltRecorder is a pin that records whether it has been halted.
+type haltRecorder struct {
+	*gpiotest.Pin
+	halted bool
+}
+
+func (p *haltRecorder) Halt() error {
+	p.halted = true
+	return p.Pin.Halt()
+}
+
+func TestRelayRebindPinKeepsOldPinOnFailure(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	old, fresh := &haltRecorder{Pin: &gpiotest.Pin{N: "OLD"}}, &gpiotest.Pin{N: "NEW"}
+	sp := pinProvider{ServiceAgent: &ServiceAgent{}, pins: map[string]gpio.PinIO{
+		"OLD":    old,
+		"NEW":    fresh,
+		"BROKEN": brokenPin{&gpiotest.Pin{N: "BROKEN"}},
+	}}
+	m := &RelayModule{}
+	if err := m.Initialize(sp, binder([]byte(`{"pin": "OLD"}`))); err != nil {
+		t.Fatalf("initialize failed: %v", err)
+	}
+
+	if err := m.RebindPin(sp, "BROKEN"); err == nil {
+		t.Fatal("expected rebinding to a broken pin to fail")
+	}
+	if pins := m.Pins(); !reflect.DeepEqual(pins, []string{"OLD"}) || old.halted {
+		t.Errorf("bound to %v with the old pin halted: %v, after a failed rebind", pins, old.halted)
+	}
+	if _, err := m.Act("set", binder([]byte(`{"high": true}`))); err != nil {
+		t.Fatalf("set failed: %v", err)
+	}
+	if got := level(old.Pin); got != gpio.High {
+		t.Errorf("old pin is %s, want it still driven high", got)
+	}
+
+	if err := m.RebindPin(sp, "NEW"); err != nil {
+		t.Fatalf("rebind failed: %v", err)
+	}
+	if got := level(fresh); got != gpio.High || !old.halted {
+		t.Errorf("new pin is %s with the old pin halted: %v, want it driven high and the old pin halted", got, old.halted)
+	}
+	if config := m.SnapshotConfig().(RelayModuleConfig); config.Pin != "NEW" {
+		t.Errorf("config has pin %s, want NEW", config.Pin)
+	}
+}
+
+func TestRelayModuleConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		body    string
+		wantErr bool
+	}{
+		{`{"pin": "1"}`, false},
+		{`{"pin": "1", "initial_state": "on", "safe_state": "off"}`, false},
+		{`{"pin": "1", "initial_state": "high"}`, true},
+		{`{"pin": "1", "safe_state": "low"}`, true},
+		{`{"pin": "1", "min_interval_ms": -1}`, true},
+	} {
+		if err := bind(tc.body, &RelayModuleConfig{}); (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.body, err, tc.wantErr)
+		}
+	}
+}
+
+func TestRelayMinInterval(t *testing.T) {
+	binder := (&ManagerAgent{}).Binder
+	pin := &gpiotest.Pin{N: "CHATTER"}
+	m := &RelayModule{pin: pin, minInterval: 50 * time.Millisecond}
+
+	if _, err := m.Act("set", binder([]byte(`{"high": true}`))); err != nil {
+		t.Fatalf("first set failed: %v", err)
+	}
+	for _, action := range []string{"set", "toggle", "pulse"} {
+		_, err := m.Act(action, binder([]byte(`{"high": false, "ms": 1}`)))
+		var rlErr RateLimitError
+		if !errors.As(err, &rlErr) || rlErr.Remaining <= 0 || rlErr.Remaining > 50*time.Millisecond {
+			t.Errorf("rapid %s got %v, want a RateLimitError", action, err)
+		}
+	}
+	if level(pin) != gpio.High {
+		t.Error("a rejected action drove the relay")
+	}
+
+	// rejected actions don't push back the next allowed one
+	time.Sleep(60 * time.Millisecond)
+	if _, err := m.Act("set", binder([]byte(`{"high": false}`))); err != nil {
+		t.Errorf("set after the interval failed: %v", err)
+	}
+	if level(pin) != gpio.Low {
+		t.Error("set after the interval didn't drive the relay")
+	}
+}
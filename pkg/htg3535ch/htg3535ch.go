@@ -38,9 +38,17 @@ func NewTemperatureK(tPin analog.PinADC, batchResistanceOhms float64, vccVolts a
 //Read takes a reading from the underlying ADS1115 and converts the voltage
 //value to a temperature reading in Kelvins.
 func (s TemperatureK) Read() (float64, error) {
+	temp, _, err := s.ReadWithResistance()
+	return temp, err
+}
+
+//ReadWithResistance takes a reading like Read, but also returns the
+//computed NTC thermistor resistance in ohms, which can be compared against
+//the datasheet curve to diagnose a drifting thermistor.
+func (s TemperatureK) ReadWithResistance() (float64, float64, error) {
 	sample, err := s.TempADS.Read()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
 	}
 	v := float64(sample.V) / float64(physic.Volt)
 
@@ -48,7 +56,7 @@ func (s TemperatureK) Read() (float64, error) {
 	if s.VCCVolts != nil {
 		sample, err = s.VCCVolts.Read()
 		if err != nil {
-			return 0, err
+			return 0, 0, err
 		}
 		vcc = float64(sample.V) / float64(physic.Volt)
 	} else {
@@ -58,7 +66,7 @@ func (s TemperatureK) Read() (float64, error) {
 	ntcResistanceOhms := s.BatchResistanceOhms * v / (vcc - v)
 	logR := math.Log(ntcResistanceOhms)
 	temp := 1 / (8.61393e-04 + 2.56377e-04*logR + 1.68055e-07*logR*logR*logR)
-	return temp, nil
+	return temp, ntcResistanceOhms, nil
 }
 
 //Humidity represents the HTG pin for measure relative humidity in percent
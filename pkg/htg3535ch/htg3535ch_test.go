@@ -0,0 +1,55 @@
+package htg3535ch
+
+import (
+	"math"
+	"testing"
+
+	"periph.io/x/periph/conn/physic"
+	"periph.io/x/periph/experimental/conn/analog"
+)
+
+// fixedADC is an analog pin that always reads the same voltage.
+type fixedADC physic.ElectricPotential
+
+func (fixedADC) String() string   { return "FIXED_ADC" }
+func (fixedADC) Name() string     { return "FIXED_ADC" }
+func (fixedADC) Number() int      { return -1 }
+func (fixedADC) Function() string { return "ADC" }
+func (fixedADC) Halt() error      { return nil }
+func (fixedADC) Range() (analog.Sample, analog.Sample) {
+	return analog.Sample{}, analog.Sample{V: 5 * physic.Volt}
+}
+func (p fixedADC) Read() (analog.Sample, error) {
+	return analog.Sample{V: physic.ElectricPotential(p)}, nil
+}
+
+func TestReadWithResistance(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sensor   TemperatureK
+		wantOhms float64
+	}{
+		{"default vcc", NewDefaultTemperatureK(fixedADC(2500 * physic.MilliVolt)), 10000},
+		{"measured vcc", NewCalibrationTemperatureK(fixedADC(1650*physic.MilliVolt), fixedADC(3300*physic.MilliVolt)), 10000},
+		{"cold", NewDefaultTemperatureK(fixedADC(4 * physic.Volt)), 40000},
+	} {
+		tk, ohms, err := tc.sensor.ReadWithResistance()
+		if err != nil {
+			t.Fatalf("%s: read failed: %v", tc.name, err)
+		}
+		if math.Abs(ohms-tc.wantOhms) > 1e-6 {
+			t.Errorf("%s: got %v ohms, want %v", tc.name, ohms, tc.wantOhms)
+		}
+
+		// Read shares the same math
+		if read, err := tc.sensor.Read(); err != nil || read != tk {
+			t.Errorf("%s: Read got %v, %v, want %v", tc.name, read, err, tk)
+		}
+	}
+
+	// a 10k NTC reads 10k ohms at 25C
+	tk, _, _ := NewDefaultTemperatureK(fixedADC(2500 * physic.MilliVolt)).ReadWithResistance()
+	if math.Abs(tk-298.15) > 0.5 {
+		t.Errorf("got %vK at 10k ohms, want about 298.15K", tk)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MinScheduleInterval keeps a schedule from hammering a module.
+const MinScheduleInterval = 100 * time.Millisecond
+
+// ScheduleStopTimeout bounds how long removing a schedule waits for its
+// in-flight run. A run that outlasts it finishes in the background.
+const ScheduleStopTimeout = 5 * time.Second
+
+// ScheduleSpec describes an action to perform on a module at a fixed
+// interval.
+type ScheduleSpec struct {
+	Module          string          `json:"module"`
+	Action          string          `json:"action"`
+	Config          json.RawMessage `json:"config"`
+	IntervalSeconds float64         `json:"interval_seconds"`
+}
+
+func (s ScheduleSpec) Validate() error {
+	if s.Module == "" {
+		return errors.New("module is required")
+	}
+	if s.interval() < MinScheduleInterval {
+		return fmt.Errorf("interval_seconds must be at least %v", MinScheduleInterval.Seconds())
+	}
+	return nil
+}
+
+func (s ScheduleSpec) interval() time.Duration {
+	return time.Duration(s.IntervalSeconds * float64(time.Second))
+}
+
+// ScheduleStatus reports a schedule's spec along with the outcome of its
+// most recent run.
+type ScheduleStatus struct {
+	ID string `json:"id"`
+	ScheduleSpec
+
+	Runs       int         `json:"runs"`
+	LastRun    *Timestamp  `json:"last_run,omitempty"`
+	LastResult interface{} `json:"last_result,omitempty"`
+	LastError  string      `json:"last_error,omitempty"`
+}
+
+// Scheduler periodically invokes module actions through an ActionRunner
+// and keeps the latest result of each.
+type Scheduler struct {
+	runner *ActionRunner
+
+	mu        sync.Mutex
+	nextID    int
+	schedules map[string]*schedule
+}
+
+type schedule struct {
+	spec ScheduleSpec
+	stop chan struct{}
+	done chan struct{}
+
+	mu         sync.Mutex
+	runs       int
+	lastRun    time.Time
+	lastResult interface{}
+	lastError  string
+}
+
+func NewScheduler(runner *ActionRunner) *Scheduler {
+	return &Scheduler{
+		runner:    runner,
+		schedules: map[string]*schedule{},
+	}
+}
+
+// Add starts running spec in the background and returns its id.
+func (s *Scheduler) Add(spec ScheduleSpec) (string, error) {
+	if err := spec.Validate(); err != nil {
+		return "", InputError{error: err}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	sched := &schedule{
+		spec: spec,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.schedules[id] = sched
+
+	go sched.run(s.runner)
+	return id, nil
+}
+
+// Remove stops the schedule with the given id and waits up to
+// ScheduleStopTimeout for any in-flight run to finish.
+func (s *Scheduler) Remove(id string) error {
+	s.mu.Lock()
+	sched, ok := s.schedules[id]
+	delete(s.schedules, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return NotFoundError{error: fmt.Errorf("no such schedule `%s`", id)}
+	}
+	close(sched.stop)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ScheduleStopTimeout)
+	defer cancel()
+	s.await(ctx, id, sched)
+	return nil
+}
+
+// StopAll stops every schedule, and waits for in-flight runs to finish
+// until ctx is done.
+func (s *Scheduler) StopAll(ctx context.Context) {
+	s.mu.Lock()
+	stopped := s.schedules
+	s.schedules = map[string]*schedule{}
+	s.mu.Unlock()
+
+	for _, sched := range stopped {
+		close(sched.stop)
+	}
+	for id, sched := range stopped {
+		s.await(ctx, id, sched)
+	}
+}
+
+// await waits for a stopped schedule's goroutine to exit, giving up when ctx
+// is done.
+func (s *Scheduler) await(ctx context.Context, id string, sched *schedule) {
+	select {
+	case <-sched.done:
+	case <-ctx.Done():
+		s.runner.Manager.Logger.Warn("gave up waiting for scheduled action", "schedule", id, "module", sched.spec.Module, "action", sched.spec.Action)
+	}
+}
+
+// List reports every schedule, ordered by id.
+func (s *Scheduler) List() []ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]ScheduleStatus, 0, len(s.schedules))
+	for id, sched := range s.schedules {
+		statuses = append(statuses, sched.status(id))
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, _ := strconv.Atoi(statuses[i].ID)
+		b, _ := strconv.Atoi(statuses[j].ID)
+		return a < b
+	})
+	return statuses
+}
+
+func (sched *schedule) run(runner *ActionRunner) {
+	defer close(sched.done)
+
+	// the labels of the reading gauge this schedule updates, which goes
+	// stale once it stops
+	var module, action string
+	defer func() {
+		if module != "" {
+			runner.Metrics.ForgetReading(module, action)
+		}
+	}()
+
+	ticker := time.NewTicker(sched.spec.interval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sched.stop:
+			return
+		case <-ticker.C:
+			req := ActRequest{Module: sched.spec.Module, Action: sched.spec.Action, Config: sched.spec.Config}
+			result, err := runner.Run(context.Background(), req, runner.Timeout)
+			sched.record(result, err)
+			if err == nil {
+				module, action = runner.Manager.MetricLabels(req.Module, req.Action)
+				runner.Metrics.RecordReading(module, action, result)
+			}
+		}
+	}
+}
+
+func (sched *schedule) record(result interface{}, err error) {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+
+	sched.runs++
+	sched.lastRun = time.Now()
+	sched.lastResult = result
+	sched.lastError = ""
+	if err != nil {
+		sched.lastError = err.Error()
+	}
+}
+
+func (sched *schedule) status(id string) ScheduleStatus {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+
+	status := ScheduleStatus{
+		ID:           id,
+		ScheduleSpec: sched.spec,
+		Runs:         sched.runs,
+		LastResult:   sched.lastResult,
+		LastError:    sched.lastError,
+	}
+	if !sched.lastRun.IsZero() {
+		ts := Timestamp(sched.lastRun)
+		status.LastRun = &ts
+	}
+	return status
+}
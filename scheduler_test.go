@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleSpecValidate(t *testing.T) {
+	for _, tc := range []struct {
+		spec    ScheduleSpec
+		wantErr bool
+	}{
+		{ScheduleSpec{Module: "a", IntervalSeconds: 0.1}, false},
+		{ScheduleSpec{Module: "a", IntervalSeconds: 60}, false},
+		{ScheduleSpec{IntervalSeconds: 60}, true},
+		{ScheduleSpec{Module: "a", IntervalSeconds: 0.05}, true},
+	} {
+		if err := tc.spec.Validate(); (err != nil) != tc.wantErr {
+			t.Errorf("%+v: got error %v, want error: %v", tc.spec, err, tc.wantErr)
+		}
+	}
+}
+
+func TestSchedulerRunsUntilRemoved(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 7}`)})
+	mod := mgr.Modules["a"].(*fakeModule)
+	scheduler := NewScheduler(NewActionRunner(mgr, NewActionMetrics(), DefaultActTimeout))
+	defer scheduler.StopAll(context.Background())
+
+	id, err := scheduler.Add(ScheduleSpec{Module: "a", Action: "read", IntervalSeconds: 0.1})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for scheduler.List()[0].Runs < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("schedule only ran %d times", scheduler.List()[0].Runs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := scheduler.List()[0]
+	if status.ID != id || status.LastResult != 7.0 || status.LastError != "" || status.LastRun == nil {
+		t.Errorf("got status %+v", status)
+	}
+
+	if err := scheduler.Remove(id); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	mod.mu.Lock()
+	acts := mod.acts
+	mod.mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	mod.mu.Lock()
+	defer mod.mu.Unlock()
+	if mod.acts != acts {
+		t.Errorf("schedule kept running after it was removed")
+	}
+	if len(scheduler.List()) != 0 {
+		t.Error("removed schedule is still listed")
+	}
+}
+
+func TestScheduledReadingsAreExported(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 7}`)})
+	runner := NewActionRunner(mgr, NewActionMetrics(), DefaultActTimeout)
+	scheduler := NewScheduler(runner)
+	defer scheduler.StopAll(context.Background())
+
+	series := `pihub_reading{action="read",module="a"} 7`
+	if strings.Contains(scrape(t, runner.Metrics), series) {
+		t.Fatal("reading was exported before anything was scheduled")
+	}
+
+	id, err := scheduler.Add(ScheduleSpec{Module: "a", Action: "read", IntervalSeconds: 0.1})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(scrape(t, runner.Metrics), series) {
+		if time.Now().After(deadline) {
+			t.Fatalf("/metrics never had series %s", series)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := scheduler.Remove(id); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if strings.Contains(scrape(t, runner.Metrics), "pihub_reading") {
+		t.Error("reading is still exported after its schedule was removed")
+	}
+}
+
+func TestScheduledActionsTimeOut(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	runner := NewActionRunner(mgr, NewActionMetrics(), 50*time.Millisecond)
+	scheduler := NewScheduler(runner)
+	defer scheduler.StopAll(context.Background())
+
+	id, err := scheduler.Add(ScheduleSpec{Module: "a", Action: "sleep", Config: json.RawMessage(`{"ms": 5000}`), IntervalSeconds: 0.1})
+	if err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for scheduler.List()[0].Runs < 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("schedule never finished a run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	want := TimeoutError{Module: "a", Action: "sleep", Timeout: 50 * time.Millisecond}.Error()
+	if status := scheduler.List()[0]; status.LastError != want {
+		t.Errorf("got last error %q, want %q", status.LastError, want)
+	}
+
+	start := time.Now()
+	if err := scheduler.Remove(id); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("remove took %s", elapsed)
+	}
+
+	if series := `pihub_action_errors_total{action="sleep",module="a"}`; !strings.Contains(scrape(t, runner.Metrics), series) {
+		t.Errorf("/metrics is missing series %s", series)
+	}
+}
+
+func TestScheduleEndpoints(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	if resp, _ := post(t, srv, "/schedule", `{"module": "a", "interval_seconds": 0}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("an invalid schedule got status %d, want 400", resp.StatusCode)
+	}
+
+	resp, body := post(t, srv, "/schedule", `{"module": "a", "action": "read", "interval_seconds": 60}`)
+	var scheduled ScheduleResponse
+	if err := json.Unmarshal(body, &scheduled); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /schedule got status %d: %s", resp.StatusCode, body)
+	}
+
+	del := func() int {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/schedule/"+scheduled.ID, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("DELETE failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := del(); status != http.StatusNoContent {
+		t.Errorf("DELETE got status %d, want 204", status)
+	}
+	if status := del(); status != http.StatusNotFound {
+		t.Errorf("second DELETE got status %d, want 404", status)
+	}
+}
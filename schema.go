@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Describer is implemented by modules that can describe their config and
+// actions, for clients like UIs that build forms from GET /schema.
+type Describer interface {
+	Describe() ModuleDescriptor
+}
+
+// ModuleDescriptor describes a module source. Config and each action's
+// Request are zero values of the types they bind into, or nil for actions
+// that take no body.
+type ModuleDescriptor struct {
+	Config  interface{}
+	Actions []ActionDescriptor
+
+	// AnyAction marks modules, like echo, that accept any action name.
+	AnyAction bool
+}
+
+type ActionDescriptor struct {
+	Name    string
+	Request interface{}
+}
+
+// ModuleSchema is the JSON form of a ModuleDescriptor, with every type
+// replaced by its shape: an object of field shapes, a one-element array of
+// the element shape, or one of "string", "integer", "number", "boolean" and
+// "any".
+type ModuleSchema struct {
+	Described bool           `json:"described"`
+	Config    interface{}    `json:"config,omitempty"`
+	Actions   []ActionSchema `json:"actions,omitempty"`
+	AnyAction bool           `json:"any_action,omitempty"`
+}
+
+type ActionSchema struct {
+	Name    string      `json:"name"`
+	Request interface{} `json:"request,omitempty"`
+}
+
+// DescribeSources builds the schema of every module source in ModuleIndex.
+func DescribeSources() map[string]ModuleSchema {
+	schemas := map[string]ModuleSchema{}
+	for source, factory := range ModuleIndex {
+		mod := factory()
+		d, ok := mod.(Describer)
+		if !ok {
+			schemas[source] = ModuleSchema{}
+			continue
+		}
+
+		descriptor := d.Describe()
+		schema := ModuleSchema{
+			Described: true,
+			Config:    shapeOf(reflect.TypeOf(descriptor.Config)),
+			AnyAction: descriptor.AnyAction,
+		}
+		for _, action := range descriptor.Actions {
+			schema.Actions = append(schema.Actions, ActionSchema{
+				Name:    action.Name,
+				Request: shapeOf(reflect.TypeOf(action.Request)),
+			})
+		}
+
+		// handled by the ManagerAgent rather than the module
+		if _, ok := mod.(PinRebinder); ok {
+			schema.Actions = append(schema.Actions, ActionSchema{
+				Name:    RebindPinAction,
+				Request: shapeOf(reflect.TypeOf(RebindPinRequest{})),
+			})
+		}
+		sort.Slice(schema.Actions, func(i, j int) bool {
+			return schema.Actions[i].Name < schema.Actions[j].Name
+		})
+
+		schemas[source] = schema
+	}
+	return schemas
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// shapeOf describes how a value of type t is encoded as JSON.
+func shapeOf(t reflect.Type) interface{} {
+	if t == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		// encoding/json encodes byte slices as base64 strings
+		if t == rawMessageType {
+			return "any"
+		}
+		if t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 {
+			return "string"
+		}
+		return []interface{}{shapeOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"*": shapeOf(t.Elem())}
+	case reflect.Struct:
+		fields := map[string]interface{}{}
+		addFieldShapes(t, fields)
+		return fields
+	default:
+		return "any"
+	}
+}
+
+// addFieldShapes adds the shape of each of t's encoded fields to fields,
+// flattening embedded structs the way encoding/json does.
+func addFieldShapes(t reflect.Type, fields map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			addFieldShapes(f.Type, fields)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = shapeOf(f.Type)
+	}
+}
+
+// SensitiveTag marks a config or request field whose value must never be
+// logged, as in `pihub:"sensitive"`.
+const SensitiveTag = "sensitive"
+
+// SensitiveFields collects the JSON names of every field tagged sensitive in
+// the configs and action requests of the module sources in ModuleIndex.
+func SensitiveFields() map[string]bool {
+	names := map[string]bool{}
+	seen := map[reflect.Type]bool{}
+	for _, factory := range ModuleIndex {
+		d, ok := factory().(Describer)
+		if !ok {
+			continue
+		}
+		descriptor := d.Describe()
+		addSensitiveFields(reflect.TypeOf(descriptor.Config), names, seen)
+		for _, action := range descriptor.Actions {
+			addSensitiveFields(reflect.TypeOf(action.Request), names, seen)
+		}
+	}
+	return names
+}
+
+// addSensitiveFields adds the JSON name of each field tagged sensitive in t,
+// or in any type t is built from, to names.
+func addSensitiveFields(t reflect.Type, names map[string]bool, seen map[reflect.Type]bool) {
+	if t == nil || seen[t] {
+		return
+	}
+	seen[t] = true
+
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+		addSensitiveFields(t.Elem(), names, seen)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (f.PkgPath != "" && !f.Anonymous) {
+				continue
+			}
+			if f.Tag.Get("pihub") == SensitiveTag {
+				name := strings.Split(tag, ",")[0]
+				if name == "" {
+					name = f.Name
+				}
+				names[name] = true
+			}
+			addSensitiveFields(f.Type, names, seen)
+		}
+	}
+}
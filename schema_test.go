@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSchemaDescribesRelay(t *testing.T) {
+	srv := newTestServer(t, newTestManager())
+	resp, err := http.Get(srv.URL + "/schema")
+	if err != nil {
+		t.Fatalf("GET /schema failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var schemas map[string]ModuleSchema
+	if err := json.NewDecoder(resp.Body).Decode(&schemas); err != nil {
+		t.Fatalf("failed decoding /schema: %v", err)
+	}
+
+	relay := schemas["relay"]
+	if config, _ := relay.Config.(map[string]interface{}); !relay.Described || config["pin"] != "string" || config["inverted"] != "boolean" {
+		t.Errorf("got relay config %v", relay.Config)
+	}
+	var names []string
+	for _, action := range relay.Actions {
+		names = append(names, action.Name)
+		if action.Name == "set" && !reflect.DeepEqual(action.Request, map[string]interface{}{"high": "boolean"}) {
+			t.Errorf("got set request %v", action.Request)
+		}
+	}
+	if want := []string{"pulse", RebindPinAction, "set", "toggle"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got relay actions %v, want %v", names, want)
+	}
+
+	if fake, ok := schemas["fake"]; !ok || fake.Described {
+		t.Errorf("got %+v for a module that can't describe itself", fake)
+	}
+	if !schemas["echo"].AnyAction {
+		t.Error("echo isn't marked as accepting any action")
+	}
+}
+
+func TestShapeOf(t *testing.T) {
+	type embedded struct {
+		Inner int `json:"inner"`
+	}
+	type config struct {
+		embedded
+		Name    string            `json:"name"`
+		Ratio   *float64          `json:"ratio"`
+		Bytes   []byte            `json:"bytes"`
+		Counts  []uint16          `json:"counts"`
+		Labels  map[string]string `json:"labels"`
+		Raw     json.RawMessage   `json:"raw"`
+		Wait    time.Duration     `json:"wait"`
+		Skipped bool              `json:"-"`
+		hidden  bool
+	}
+
+	want := map[string]interface{}{
+		"inner":  "integer",
+		"name":   "string",
+		"ratio":  "number",
+		"bytes":  "string",
+		"counts": []interface{}{"integer"},
+		"labels": map[string]interface{}{"*": "string"},
+		"raw":    "any",
+		"wait":   "integer",
+	}
+	if got := shapeOf(reflect.TypeOf(config{})); !reflect.DeepEqual(got, want) {
+		t.Errorf("got shape %v, want %v", got, want)
+	}
+	if got := shapeOf(nil); got != nil {
+		t.Errorf("got shape %v for no type", got)
+	}
+}
+
+func TestAddSensitiveFields(t *testing.T) {
+	type credentials struct {
+		User  string `json:"user"`
+		Token string `json:"token" pihub:"sensitive"`
+	}
+	type config struct {
+		Pin      string                 `json:"pin"`
+		Password string                 `json:"password" pihub:"sensitive"`
+		Accounts []credentials          `json:"accounts"`
+		Backup   *credentials           `json:"backup"`
+		Extra    map[string]credentials `json:"extra"`
+		Key      string                 `pihub:"sensitive"`
+	}
+
+	names := map[string]bool{}
+	addSensitiveFields(reflect.TypeOf(config{}), names, map[reflect.Type]bool{})
+	if want := map[string]bool{"password": true, "token": true, "Key": true}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got sensitive fields %v, want %v", names, want)
+	}
+}
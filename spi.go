@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"periph.io/x/periph/conn/spi"
+	"periph.io/x/periph/conn/spi/spireg"
+)
+
+// spiPorts tracks the SPI ports a ServiceAgent has handed out, so that any
+// still open at shutdown can be closed. Unlike the default I2C bus, each
+// SPI module gets a port of its own, since a port can only be connected
+// once.
+type spiPorts struct {
+	mu   sync.Mutex
+	open map[*trackedSPIPort]struct{}
+}
+
+func (p *spiPorts) Open(name string) (spi.PortCloser, error) {
+	port, err := spireg.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open == nil {
+		p.open = map[*trackedSPIPort]struct{}{}
+	}
+	tracked := &trackedSPIPort{PortCloser: port, ports: p}
+	p.open[tracked] = struct{}{}
+	return tracked, nil
+}
+
+// CloseAll closes every port that hasn't been closed already.
+func (p *spiPorts) CloseAll() error {
+	p.mu.Lock()
+	ports := p.open
+	p.open = nil
+	p.mu.Unlock()
+
+	var failed error
+	for port := range ports {
+		if err := port.PortCloser.Close(); err != nil && failed == nil {
+			failed = fmt.Errorf("failed closing SPI port %s: %w", port, err)
+		}
+	}
+	return failed
+}
+
+type trackedSPIPort struct {
+	spi.PortCloser
+	ports *spiPorts
+}
+
+func (p *trackedSPIPort) Close() error {
+	p.ports.mu.Lock()
+	_, open := p.ports.open[p]
+	delete(p.ports.open, p)
+	p.ports.mu.Unlock()
+
+	if !open {
+		return nil
+	}
+	return p.PortCloser.Close()
+}
+
+// spiAvailable reports whether periph found any SPI ports.
+func spiAvailable() bool {
+	return len(spireg.All()) > 0
+}
+
+var errNoSPIPort = errors.New("no spi port is available")
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StateFile persists the hub's modules across restarts. A StateFile with no
+// Path, or a nil one, persists nothing.
+type StateFile struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+// Save writes snapshot to the state file, replacing it atomically so that a
+// crash mid-write can't leave a truncated file behind.
+func (s *StateFile) Save(snapshot Snapshot) error {
+	if s == nil || s.Path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed encoding state: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed creating state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(bs); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed writing state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed writing state file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		return fmt.Errorf("failed replacing state file: %w", err)
+	}
+	return nil
+}
+
+// Load reads the last saved snapshot. A missing state file yields an empty
+// snapshot rather than an error, since that's the state of a fresh install.
+func (s *StateFile) Load() (Snapshot, error) {
+	snapshot := Snapshot{Modules: map[string]ModuleSpec{}}
+	if s == nil || s.Path == "" {
+		return snapshot, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bs, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return snapshot, fmt.Errorf("failed reading state file: %w", err)
+	}
+
+	if err := json.Unmarshal(bs, &snapshot); err != nil {
+		return snapshot, fmt.Errorf("failed decoding state file: %w", err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// MinStreamInterval keeps a stream from hammering a module.
+const MinStreamInterval = 100 * time.Millisecond
+
+// streamWriteTimeout bounds how long a frame can take to reach a slow
+// client before the stream is given up on.
+const streamWriteTimeout = 10 * time.Second
+
+// StreamRequest is the first message a /stream client sends, naming the
+// action to perform at each interval.
+type StreamRequest struct {
+	Module     string          `json:"module"`
+	Action     string          `json:"action"`
+	Config     json.RawMessage `json:"config"`
+	IntervalMS int             `json:"interval_ms"`
+}
+
+func (r StreamRequest) Validate() error {
+	if r.Module == "" {
+		return errors.New("module is required")
+	}
+	if r.interval() < MinStreamInterval {
+		return fmt.Errorf("interval_ms must be at least %d", MinStreamInterval.Milliseconds())
+	}
+	return nil
+}
+
+func (r StreamRequest) interval() time.Duration {
+	return time.Duration(r.IntervalMS) * time.Millisecond
+}
+
+// StreamFrame is one reading pushed to a /stream client. Seq counts up from
+// 1 with every frame, so a client can tell if it missed any, and Timestamp
+// is when the reading was taken. A failed reading carries Error instead of
+// Result, and the stream carries on.
+type StreamFrame struct {
+	Seq       uint64      `json:"seq"`
+	Timestamp Timestamp   `json:"timestamp"`
+	Result    interface{} `json:"result,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+var streamUpgrader = websocket.Upgrader{}
+
+// streamHandler serves a WebSocket that performs one action at a fixed
+// interval and pushes each result, until the client disconnects. Each
+// action gets the timeout in the ActTimeoutHeader of the upgrade request,
+// as it would on /act.
+func streamHandler(runner *ActionRunner) http.Handler {
+	mgr := runner.Manager
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := requestTimeout(r, runner.Timeout)
+		if err != nil {
+			mgr.Logger.WarnContext(r.Context(), "invalid request timeout", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		conn, err := streamUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already responded with an error
+			mgr.Logger.WarnContext(r.Context(), "failed upgrading stream connection", "error", err)
+			return
+		}
+		defer conn.Close()
+
+		var req StreamRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			closeStream(r.Context(), mgr.Logger, conn, websocket.CloseUnsupportedData, fmt.Sprintf("failed decoding stream request: %s", err.Error()))
+			return
+		}
+		if err := req.Validate(); err != nil {
+			closeStream(r.Context(), mgr.Logger, conn, websocket.ClosePolicyViolation, fmt.Sprintf("invalid stream request: %s", err.Error()))
+			return
+		}
+
+		// the client has nothing more to say, but reading is how we find out
+		// that it has gone away
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		ticker := time.NewTicker(req.interval())
+		defer ticker.Stop()
+
+		var seq uint64
+		for {
+			select {
+			case <-gone:
+				return
+			case <-ticker.C:
+			}
+
+			result, err := runner.Run(r.Context(), ActRequest{Module: req.Module, Action: req.Action, Config: req.Config}, timeout)
+
+			seq++
+			frame := StreamFrame{Seq: seq, Timestamp: Timestamp(time.Now()), Result: result}
+			if err != nil {
+				frame.Error = err.Error()
+			}
+
+			_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err := conn.WriteJSON(frame); err != nil {
+				mgr.Logger.ErrorContext(r.Context(), "failed writing stream frame", "module", req.Module, "action", req.Action, "error", err)
+				return
+			}
+		}
+	})
+}
+
+func closeStream(ctx context.Context, logger *slog.Logger, conn *websocket.Conn, code int, reason string) {
+	logger.WarnContext(ctx, "closing stream", "reason", reason)
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(streamWriteTimeout))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamFrame is a StreamFrame as a client decodes it.
+type streamFrame struct {
+	Seq    uint64      `json:"seq"`
+	Result interface{} `json:"result"`
+	Error  string      `json:"error"`
+}
+
+func dialStream(t *testing.T, srv *httptest.Server, header http.Header, request string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/stream", header)
+	if err != nil {
+		t.Fatalf("failed dialing stream: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(request)); err != nil {
+		t.Fatalf("failed sending stream request: %v", err)
+	}
+	return conn
+}
+
+func TestStreamPushesFrames(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec(`{"value": 7}`)})
+
+	for _, tc := range []struct {
+		action, config string
+		want           streamFrame
+	}{
+		{"read", `{}`, streamFrame{Result: 7.0}},
+		// errors are reported in frames, and the stream carries on
+		{"fail", `{"kind": "input"}`, streamFrame{Error: "bad input"}},
+	} {
+		conn := dialStream(t, newTestServer(t, mgr), nil, `{"module": "a", "action": "`+tc.action+`", "config": `+tc.config+`, "interval_ms": 100}`)
+		for seq := uint64(1); seq <= 3; seq++ {
+			var frame streamFrame
+			if err := conn.ReadJSON(&frame); err != nil {
+				t.Fatalf("%s: failed reading frame %d: %v", tc.action, seq, err)
+			}
+			tc.want.Seq = seq
+			if frame != tc.want {
+				t.Errorf("%s: got frame %+v, want %+v", tc.action, frame, tc.want)
+			}
+		}
+	}
+}
+
+func TestStreamRejectsInvalidRequests(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+
+	for _, tc := range []struct {
+		request string
+		code    int
+	}{
+		{`{"module": "a", "action": "read", "interval_ms": 10}`, websocket.ClosePolicyViolation},
+		{`{"action": "read", "interval_ms": 100}`, websocket.ClosePolicyViolation},
+		{`not json`, websocket.CloseUnsupportedData},
+	} {
+		conn := dialStream(t, newTestServer(t, mgr), nil, tc.request)
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != tc.code {
+			t.Errorf("%s: got %v, want close code %d", tc.request, err, tc.code)
+		}
+	}
+}
+
+func TestStreamActionsTimeOut(t *testing.T) {
+	mgr := newTestManager()
+	mustInitialize(t, mgr, map[string]ModuleSpec{"a": fakeSpec("")})
+	srv := newTestServer(t, mgr)
+
+	header := http.Header{ActTimeoutHeader: {"50ms"}}
+	conn := dialStream(t, srv, header, `{"module": "a", "action": "sleep", "config": {"ms": 5000}, "interval_ms": 100}`)
+	var frame streamFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("failed reading frame: %v", err)
+	}
+	if want := (TimeoutError{Module: "a", Action: "sleep", Timeout: 50 * time.Millisecond}).Error(); frame.Error != want {
+		t.Errorf("got error %q, want %q", frame.Error, want)
+	}
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("GET /metrics failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed reading /metrics: %v", err)
+	}
+	if series := `pihub_action_errors_total{action="sleep",module="a"}`; !strings.Contains(string(body), series) {
+		t.Errorf("/metrics is missing series %s", series)
+	}
+}